@@ -0,0 +1,344 @@
+// Package asmtest runs unit tests written in DCPU assembly.
+//
+// A test is a routine of the tested file, or of a file it includes, whose
+// label starts with "test_". Each test runs in a fresh DCPU with the
+// assembled program. It starts at its label with an empty stack and passes
+// if it returns by SET PC, POP within the cycle budget, and the
+// expectations in its comments hold:
+//
+//	:test_double
+//		; expect A = 0x40, [result] = 1
+//		SET A, 0x20
+//		JSR double
+//		SET PC, POP
+//
+// An expectation compares a register, or the word at an address, with a
+// value. Addresses and values are numbers, or labels and constants with an
+// optional offset like "buffer+2". The expectations of a test are the
+// comments between its label and the next non-local label in its file.
+//
+// A test fails if it halts before returning, so tests can check conditions
+// in code by jumping to a label like ":fail SET PC, fail". The DCPU has no
+// hardware in this version of the specification, so there is no device
+// through which tests could report failures.
+package asmtest
+
+import (
+	"github.com/xconstruct/dcpu16/assembler"
+	"github.com/xconstruct/dcpu16/assembler/scanner"
+	"github.com/xconstruct/dcpu16/assembler/token"
+	"github.com/xconstruct/dcpu16/emulator"
+	"github.com/xconstruct/dcpu16/sourcemap"
+	"github.com/xconstruct/dcpu16/symbols"
+	"github.com/xconstruct/dcpu16/trace"
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Prefix of the labels of tests.
+const Prefix = "test_"
+
+// The stack of a test starts with the address returnAddr, at which lies
+// the word haltWord, SUB PC, 1, so that the DCPU halts there when the
+// test returns.
+const (
+	returnAddr = 0xffff
+	haltWord   = 0x85c3
+)
+
+// Test is a test routine of a program.
+type Test struct {
+	Name   string
+	Addr   uint16
+	Pos    token.Position // position of its label
+	Expect []Expectation
+}
+
+// Expectation is the expected value of a register or word after a test.
+type Expectation struct {
+	Pos   token.Position
+	Reg   string // name of the register, or empty for the word at Addr
+	Addr  string
+	Value string
+}
+
+func (e Expectation) String() string {
+	if e.Reg != "" {
+		return e.Reg
+	}
+	return "[" + e.Addr + "]"
+}
+
+// Find returns the tests of an assembled program with the expectations
+// in their source, in the order of their addresses. The symbols must hold
+// the positions of the labels, as written by the assembler.
+func Find(syms symbols.Map) ([]*Test, error) {
+	// lines of the global labels of each file, which end the tests
+	ends := make(map[string][]int)
+	for _, sym := range syms {
+		if !isLocal(sym.Name) && sym.Line > 0 {
+			ends[sym.File] = append(ends[sym.File], sym.Line)
+		}
+	}
+
+	comments := make(map[string][]comment)
+	tests := make([]*Test, 0)
+	for _, sym := range syms {
+		if isLocal(sym.Name) || !strings.HasPrefix(sym.Name, Prefix) {
+			continue
+		}
+		test := &Test{Name: sym.Name, Addr: sym.Addr, Pos: token.Position{Filename: sym.File, Line: sym.Line}}
+		tests = append(tests, test)
+		if sym.File == "" || sym.Line == 0 {
+			continue
+		}
+		if _, ok := comments[sym.File]; !ok {
+			src, err := ioutil.ReadFile(sym.File)
+			if err != nil {
+				return nil, err
+			}
+			comments[sym.File] = scanComments(src, sym.File)
+		}
+		end := 0
+		for _, line := range ends[sym.File] {
+			if line > sym.Line && (end == 0 || line < end) {
+				end = line
+			}
+		}
+		for _, c := range comments[sym.File] {
+			if c.pos.Line < sym.Line || end > 0 && c.pos.Line >= end || !strings.HasPrefix(c.text, "expect ") {
+				continue
+			}
+			for _, e := range strings.Split(c.text[len("expect "):], ",") {
+				exp, err := parseExpectation(e, c.pos)
+				if err != nil {
+					return nil, err
+				}
+				test.Expect = append(test.Expect, exp)
+			}
+		}
+	}
+	return tests, nil
+}
+
+// isLocal reports whether a label is local to the label before it, like
+// "main.loop", or to a macro expansion, like "again@3".
+func isLocal(name string) bool {
+	return strings.ContainsAny(name, ".@")
+}
+
+type comment struct {
+	pos  token.Position
+	text string
+}
+
+// scanComments returns the comments of a source file.
+func scanComments(src []byte, filename string) []comment {
+	s := &scanner.Scanner{}
+	s.InitFile(filename, src)
+	comments := make([]comment, 0)
+	for {
+		tok, lit := s.Scan()
+		switch tok {
+		case token.EOF:
+			return comments
+		case token.COMMENT:
+			comments = append(comments, comment{s.Pos(), strings.TrimSpace(lit)})
+		}
+	}
+}
+
+func parseExpectation(s string, pos token.Position) (e Expectation, err error) {
+	e.Pos = pos
+	eq := strings.Index(s, "=")
+	if eq < 0 {
+		return e, errors.New(fmt.Sprintf("%s:%d: expected target = value in %q", pos.Filename, pos.Line, strings.TrimSpace(s)))
+	}
+	target := strings.TrimSpace(s[:eq])
+	e.Value = strings.TrimSpace(s[eq+1:])
+	if strings.HasPrefix(target, "[") && strings.HasSuffix(target, "]") {
+		e.Addr = strings.TrimSpace(target[1 : len(target)-1])
+	} else {
+		e.Reg = strings.ToUpper(target)
+		if trace.Register(e.Reg) < 0 {
+			return e, errors.New(fmt.Sprintf("%s:%d: unknown register %s", pos.Filename, pos.Line, target))
+		}
+	}
+	if e.Value == "" || e.Reg == "" && e.Addr == "" {
+		return e, errors.New(fmt.Sprintf("%s:%d: expected target = value in %q", pos.Filename, pos.Line, strings.TrimSpace(s)))
+	}
+	return e, nil
+}
+
+// resolve returns the value of a number, or of a label or constant with an
+// offset.
+func resolve(s string, syms symbols.Map, consts map[string]uint16) (uint16, error) {
+	if n, err := strconv.ParseInt(s, 0, 32); err == nil && n >= -0x8000 && n <= 0xffff {
+		return uint16(n), nil
+	}
+	name, offset := s, int64(0)
+	if i := strings.IndexAny(s, "+-"); i > 0 {
+		var err error
+		name = strings.TrimSpace(s[:i])
+		offset, err = strconv.ParseInt(strings.Replace(s[i:], " ", "", -1), 0, 32)
+		if err != nil {
+			return 0, errors.New(fmt.Sprintf("invalid offset in %s", s))
+		}
+	}
+	for _, sym := range syms {
+		if sym.Name == name {
+			return sym.Addr + uint16(offset), nil
+		}
+	}
+	if v, ok := consts[name]; ok {
+		return v + uint16(offset), nil
+	}
+	return 0, errors.New(fmt.Sprintf("unknown symbol %s", name))
+}
+
+// Result is the outcome of a test.
+type Result struct {
+	Test     *Test
+	Passed   bool
+	Cycles   uint64
+	Failures []string // reasons of the failure, starting with their positions
+}
+
+func (r *Result) fail(pos token.Position, format string, args ...interface{}) {
+	r.Passed = false
+	r.Failures = append(r.Failures, fmt.Sprintf("%s:%d: ", pos.Filename, pos.Line)+fmt.Sprintf(format, args...))
+}
+
+// Config configures the running of tests.
+type Config struct {
+	Cycles uint64         // cycle budget of each test, or 0 for no limit
+	Run    *regexp.Regexp // names of the tests to run, or nil for all
+}
+
+// RunFile assembles a source file and runs its tests.
+func (c *Config) RunFile(filename string) ([]*Result, error) {
+	var syms symbols.Map
+	var lines sourcemap.Map
+	var consts map[string]uint16
+	gen, err := (&assembler.Config{Symbols: &syms, SourceMap: &lines, Constants: &consts}).AssembleFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	tests, err := Find(syms)
+	if err != nil {
+		return nil, err
+	}
+	if len(gen) > returnAddr-1 {
+		return nil, errors.New(fmt.Sprintf("asmtest: %s: the program leaves no room for the stack", filename))
+	}
+
+	results := make([]*Result, 0, len(tests))
+	for _, t := range tests {
+		if c.Run != nil && !c.Run.MatchString(t.Name) {
+			continue
+		}
+		results = append(results, c.run(t, gen, syms, consts, lines))
+	}
+	return results, nil
+}
+
+// run runs a test of the program gen.
+func (c *Config) run(t *Test, gen []uint16, syms symbols.Map, consts map[string]uint16, lines sourcemap.Map) *Result {
+	r := &Result{Test: t, Passed: true}
+	d := emulator.NewDCPU()
+	d.Load(gen)
+	d.PC = t.Addr
+	d.SP = returnAddr - 1
+	d.RAM[returnAddr-1] = returnAddr
+	d.RAM[returnAddr] = haltWord
+	halted, err := d.RunCycles(nil, c.Cycles)
+	r.Cycles = d.Cycles
+	where := func() (token.Position, string) {
+		name := fmt.Sprintf("%04x", d.PC)
+		if sym := syms.Name(d.PC); sym != "" {
+			name += " " + sym
+		}
+		if l, ok := lines.Lookup(d.PC); ok {
+			return token.Position{Filename: l.File, Line: l.Line}, name
+		}
+		return t.Pos, name
+	}
+	switch {
+	case err != nil:
+		pos, name := where()
+		r.fail(pos, "%v at %s", err, name)
+		return r
+	case !halted:
+		pos, name := where()
+		r.fail(pos, "did not return within %d cycles, at %s", c.Cycles, name)
+		return r
+	case d.PC != returnAddr:
+		pos, name := where()
+		r.fail(pos, "halted at %s", name)
+		return r
+	}
+
+	for _, e := range t.Expect {
+		var got uint16
+		if e.Reg != "" {
+			got = d.Register(trace.Register(e.Reg))
+		} else {
+			a, err := resolve(e.Addr, syms, consts)
+			if err != nil {
+				r.fail(e.Pos, "%v", err)
+				continue
+			}
+			got = d.RAM[a]
+		}
+		want, err := resolve(e.Value, syms, consts)
+		if err != nil {
+			r.fail(e.Pos, "%v", err)
+			continue
+		}
+		if got != want {
+			r.fail(e.Pos, "%s = 0x%04x, expected 0x%04x", e, got, want)
+		}
+	}
+	return r
+}
+
+// Write writes the results of the tests of a file like "go test": the
+// failed tests with their failures and, if verbose, also the passed tests,
+// followed by the outcome of the file. It returns whether all tests passed.
+func Write(w io.Writer, filename string, results []*Result, verbose bool) (passed bool, err error) {
+	bw := bufio.NewWriter(w)
+	passed = true
+	var cycles uint64
+	for _, r := range results {
+		cycles += r.Cycles
+		if verbose {
+			fmt.Fprintf(bw, "=== RUN   %s\n", r.Test.Name)
+		}
+		if r.Passed {
+			if verbose {
+				fmt.Fprintf(bw, "--- PASS: %s (%d cycles)\n", r.Test.Name, r.Cycles)
+			}
+			continue
+		}
+		passed = false
+		fmt.Fprintf(bw, "--- FAIL: %s (%d cycles)\n", r.Test.Name, r.Cycles)
+		for _, f := range r.Failures {
+			fmt.Fprintf(bw, "    %s\n", f)
+		}
+	}
+	switch {
+	case !passed:
+		fmt.Fprintf(bw, "FAIL\t%s\t%d cycles\n", filename, cycles)
+	case len(results) == 0:
+		fmt.Fprintf(bw, "ok  \t%s\t[no tests to run]\n", filename)
+	default:
+		fmt.Fprintf(bw, "ok  \t%s\t%d cycles\n", filename, cycles)
+	}
+	return passed, bw.Flush()
+}
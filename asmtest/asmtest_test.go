@@ -0,0 +1,187 @@
+package asmtest
+
+import (
+	"github.com/xconstruct/dcpu16/assembler"
+	"github.com/xconstruct/dcpu16/symbols"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+const src = `.macro twice reg
+:again	ADD reg, reg
+.endm
+:double	ADD A, A
+	SET [result], 1
+	SET PC, POP
+
+:test_double
+	; expect A = 0x40, [result] = ONE
+	SET A, 0x20
+	JSR double
+	SET PC, POP
+
+:test_wrong
+	; expect a = 3
+	SET A, 1
+:_skip	JSR double
+:	twice B
+	; expect [result+1] = 0, B = stop
+	SET PC, POP
+
+:test_check
+	SET A, 2
+	JSR double
+	IFN A, 5
+		SET PC, fail
+	SET PC, POP
+
+:test_slow
+:.loop	ADD B, 1
+	SET PC, .loop
+
+:fail	SET PC, fail
+:stop	SET PC, stop
+:result	DAT 0, 0
+.equ ONE, 1
+.include "lib.dasm"
+`
+
+const lib = `
+:test_lib
+	; expect C = 7
+	SET C, 7
+	SET PC, POP
+`
+
+// writeFiles writes the test program into a temporary directory
+// and returns the path of the main file.
+func writeFiles(t *testing.T, main string) string {
+	dir, err := ioutil.TempDir("", "asmtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{"main.dasm": main, "lib.dasm": lib} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return filepath.Join(dir, "main.dasm")
+}
+
+func runFile(t *testing.T, c *Config) []*Result {
+	path := writeFiles(t, src)
+	defer os.RemoveAll(filepath.Dir(path))
+	results, err := c.RunFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return results
+}
+
+func TestFind(t *testing.T) {
+	path := writeFiles(t, src)
+	defer os.RemoveAll(filepath.Dir(path))
+	var syms symbols.Map
+	if _, err := (&assembler.Config{Symbols: &syms}).AssembleFile(path); err != nil {
+		t.Fatal(err)
+	}
+	tests, err := Find(syms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, len(tests))
+	for i, test := range tests {
+		names[i] = test.Name
+	}
+	if exp := []string{"test_double", "test_wrong", "test_check", "test_slow", "test_lib"}; !reflect.DeepEqual(names, exp) {
+		t.Fatalf("expected tests %v, got %v", exp, names)
+	}
+	exp := []Expectation{
+		{Reg: "A", Value: "3"},
+		{Addr: "result+1", Value: "0"},
+		{Reg: "B", Value: "stop"},
+	}
+	for i, line := range []int{15, 19, 19} {
+		if tests[1].Expect[i].Pos.Line != line {
+			t.Errorf("expected expectation %d on line %d, got %d", i, line, tests[1].Expect[i].Pos.Line)
+		}
+		tests[1].Expect[i].Pos = exp[i].Pos
+	}
+	if !reflect.DeepEqual(tests[1].Expect, exp) {
+		t.Errorf("expected %v, got %v", exp, tests[1].Expect)
+	}
+	if len(tests[4].Expect) != 1 || tests[4].Pos.Filename != filepath.Join(filepath.Dir(path), "lib.dasm") {
+		t.Errorf("expected test_lib in lib.dasm with an expectation, got %+v", tests[4])
+	}
+
+	for _, bad := range []string{":test_a\n; expect A\n", ":test_a\n; expect R = 1\n", ":test_a\n; expect [] = 1\n"} {
+		path := writeFiles(t, bad)
+		syms = nil
+		(&assembler.Config{Symbols: &syms}).AssembleFile(path)
+		if _, err := Find(syms); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+		os.RemoveAll(filepath.Dir(path))
+	}
+}
+
+func TestRunFile(t *testing.T) {
+	results := runFile(t, &Config{Cycles: 1000})
+	if len(results) != 5 {
+		t.Fatalf("expected 5 results, got %d", len(results))
+	}
+	exp := []struct {
+		passed   bool
+		failures []string
+	}{
+		{true, nil},
+		{false, []string{"main.dasm:15: A = 0x0002, expected 0x0003", "main.dasm:19: B = 0x0000, expected 0x0014"}},
+		{false, []string{"main.dasm:33: halted at 0013 fail"}},
+		{false, []string{"main.dasm:31: did not return within 1000 cycles, at 0012 test_slow+1"}},
+		{true, nil},
+	}
+	for i, r := range results {
+		if r.Passed != exp[i].passed || len(r.Failures) != len(exp[i].failures) {
+			t.Errorf("%s: expected passed %v with %v, got %v with %v", r.Test.Name,
+				exp[i].passed, exp[i].failures, r.Passed, r.Failures)
+			continue
+		}
+		for j, f := range r.Failures {
+			if !bytes.HasSuffix([]byte(f), []byte(exp[i].failures[j])) {
+				t.Errorf("%s: expected failure %q, got %q", r.Test.Name, exp[i].failures[j], f)
+			}
+		}
+	}
+	if results[0].Cycles != 12 {
+		t.Errorf("expected test_double to take 12 cycles, got %d", results[0].Cycles)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	results := runFile(t, &Config{Cycles: 1000, Run: regexp.MustCompile("double|check")})
+	var buf bytes.Buffer
+	passed, err := Write(&buf, "m.dasm", results, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if passed {
+		t.Errorf("expected the tests to fail")
+	}
+	exp := "=== RUN   test_double\n--- PASS: test_double (12 cycles)\n" +
+		"=== RUN   test_check\n--- FAIL: test_check (12 cycles)\n" +
+		"    " + results[1].Failures[0] + "\n" +
+		"FAIL\tm.dasm\t24 cycles\n"
+	if buf.String() != exp {
+		t.Errorf("expected\n%s\ngot\n%s", exp, buf.String())
+	}
+
+	buf.Reset()
+	if passed, _ := Write(&buf, "m.dasm", results[:1], false); !passed || buf.String() != "ok  \tm.dasm\t12 cycles\n" {
+		t.Errorf("expected the file to pass, got %v and %q", passed, buf.String())
+	}
+}
@@ -3,8 +3,15 @@ package assembler
 import (
 	"github.com/xconstruct/dcpu16/assembler/scanner"
 	"github.com/xconstruct/dcpu16/assembler/token"
+	"github.com/xconstruct/dcpu16/loader"
+	"github.com/xconstruct/dcpu16/object"
+	"github.com/xconstruct/dcpu16/sourcemap"
+	"github.com/xconstruct/dcpu16/symbols"
+	"github.com/xconstruct/dcpu16/words"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"runtime"
 	"strconv"
 	"strings"
@@ -13,6 +20,78 @@ import (
 type TokenType struct {
 	Tok token.Token
 	Lit string
+	Pos token.Position
+	Macro *Expansion // macro expansion the token stems from, or nil
+}
+
+// Error records an error at a position in the source. If the position
+// belongs to a macro, the error also points at the invocation of the macro.
+type Error struct {
+	Pos token.Position
+	Macro *Expansion
+	Err error
+	Source string // the offending source line, if known
+}
+
+// Error formats the error as "file:line:col: message", followed by
+// the source line with a marker at the column.
+func (e *Error) Error() string {
+	msg := strings.TrimPrefix(e.Err.Error(), "assembler: ")
+	s := fmt.Sprintf("%s: %s", e.Pos, msg)
+	if e.Source != "" {
+		s += "\n\t" + e.Source + "\n\t" + marker(e.Source, e.Pos.Column)
+	}
+	for m := e.Macro; m != nil; m = m.Parent {
+		s += fmt.Sprintf("\n\tin macro \"%s\" defined at %s, called at %s", m.Name, m.Def, m.Call)
+	}
+	return s
+}
+
+// marker returns a line with a caret below column col of line.
+// Tabs are kept, so that the caret lines up with the source.
+func marker(line string, col int) string {
+	b := make([]byte, 0, col)
+	for i := 0; i < col-1 && i < len(line); i++ {
+		if line[i] == '\t' {
+			b = append(b, '\t')
+		} else {
+			b = append(b, ' ')
+		}
+	}
+	return string(append(b, '^'))
+}
+
+// withPos annotates err with a position unless it already has one.
+func withPos(err error, pos token.Position, macro *Expansion) *Error {
+	if e, ok := err.(*Error); ok {
+		return e
+	}
+	return &Error{Pos: pos, Macro: macro, Err: err}
+}
+
+// ErrorList is a list of errors in the order they were found.
+type ErrorList []*Error
+
+// Add appends an error to the list.
+func (l *ErrorList) Add(err *Error) {
+	*l = append(*l, err)
+}
+
+// Error lists all errors, one after another.
+func (l ErrorList) Error() string {
+	s := make([]string, len(l))
+	for i, e := range l {
+		s[i] = e.Error()
+	}
+	return strings.Join(s, "\n")
+}
+
+// Err returns the list as an error, or nil if it is empty.
+func (l ErrorList) Err() error {
+	if len(l) == 0 {
+		return nil
+	}
+	return l
 }
 
 type UnexpectedTokenError struct {
@@ -49,9 +128,11 @@ func OpCode(tok token.Token) byte {
 	return 0x0;
 }
 
+// FixLabel records a generated word whose expression references labels
+// and can only be computed once all labels are known.
 type FixLabel struct {
 	Offset uint16
-	Label string
+	Expr Expr
 }
 
 type Parser struct {
@@ -59,9 +140,35 @@ type Parser struct {
 	tokens []TokenType
 	offset int
 	gen []uint16
-	pc int
+	pos int
+	stmts []*stmt
+	cur *stmt
+	defs map[string]int
 	labels map[string]uint16
+	consts map[string]Expr
+	resolving map[string]bool
+	conds []bool
 	fixlabels []FixLabel
+	scope string
+	anons int
+	indirect bool
+	noRelax bool
+	defines map[string]int
+	inc *includer
+	pp *preprocessor
+	includes []int // ends of the tokens of the files being included
+	warnings io.Writer
+	errors ErrorList
+	sections []*section
+	section int
+	globals []TokenType
+	object bool
+	imports map[string]bool
+	obj *object.File
+	relocatable bool
+	relocs []uint16
+	symbols map[string]token.Position   // where labels and constants are defined
+	refs map[string][]token.Position // where they are used
 }
 
 func (p *Parser) next() {
@@ -71,8 +178,29 @@ func (p *Parser) next() {
 		p.offset = rdOffset
 	} else {
 		p.offset = len(p.tokens)
-		p.tok = TokenType{token.EOF, ""}
+		p.tok = TokenType{Tok: token.EOF}
+		if len(p.tokens) > 0 {
+			p.tok.Pos = p.tokens[len(p.tokens)-1].Pos
+		}
 	}
+	p.popIncludes()
+}
+
+// splice replaces the tokens from the current one up to tokens[last] by
+// the tokens of an expansion, which are parsed next.
+func (p *Parser) splice(last int, tokens []TokenType) {
+	delta := len(tokens) - (last + 1 - p.offset)
+	for i, end := range p.includes {
+		if end > p.offset {
+			p.includes[i] = end + delta
+		}
+	}
+	out := make([]TokenType, 0, len(p.tokens)+delta)
+	out = append(out, p.tokens[:p.offset]...)
+	out = append(out, tokens...)
+	p.tokens = append(out, p.tokens[last+1:]...)
+	p.offset--
+	p.next()
 }
 
 func (p *Parser) skipIgnored() {
@@ -88,7 +216,7 @@ func (p *Parser) nextImportant() {
 
 func (p *Parser) expect(tok token.Token) {
 	if p.tok.Tok != tok {
-		panic(&UnexpectedTokenError{p.tok, TokenType{tok, ""}})
+		panic(&UnexpectedTokenError{p.tok, TokenType{Tok: tok}})
 	}
 }
 
@@ -97,27 +225,21 @@ func (p *Parser) unexpectedError() {
 }
 
 func (p *Parser) parseOp() {
-	offs := len(p.gen)
-	op := uint16(0)
-	p.gen = append(p.gen, 0x00)
+	s := p.newStmt()
 
 	if p.tok.Tok.IsBasicOp() {
-		op += uint16(OpCode(p.tok.Tok))
+		s.op = uint16(OpCode(p.tok.Tok))
 		p.nextImportant()
-		a := p.parseValue()
+		a := p.parseValue(4)
 		p.expect(token.COMMA)
 		p.nextImportant()
-		b := p.parseValue()
-		op |= uint16(a) << 4
-		op |= uint16(b) << 10
+		b := p.parseValue(10)
+		s.args = []*operand{a, b}
 	} else {
-		op += uint16(OpCode(p.tok.Tok)) << 4
+		s.op = uint16(OpCode(p.tok.Tok)) << 4
 		p.nextImportant()
-		a := p.parseValue()
-		op |= uint16(a) << 10
+		s.args = []*operand{p.parseValue(10)}
 	}
-
-	p.gen[offs] = op
 }
 
 var registers = []byte("ABCXYZIJ")
@@ -132,150 +254,722 @@ func registerOpCode(reg string) byte {
 	return 0x0
 }
 
-func (p *Parser) parseValue() (value byte) {
-	if p.tok.Tok == token.LBRACK { // indirect
+// parseValue parses an instruction operand, which is placed into the
+// instruction word at the given bit offset.
+func (p *Parser) parseValue(shift uint) *operand {
+	a := &operand{shift: shift}
+	switch p.tok.Tok {
+	case token.POP: a.code = 0x18
+	case token.PEEK: a.code = 0x19
+	case token.PUSH: a.code = 0x1a
+	case token.SP: a.code = 0x1b
+	case token.PC: a.code = 0x1c
+	case token.O: a.code = 0x1d
+	case token.REGISTER: a.code = registerOpCode(p.tok.Lit)
+	case token.LBRACK: // indirect
+		p.parseIndirect(a)
+		return a
+	default:
+		e := p.parseExpr()
+		if isConst(e) {
+			if n := p.mustEval(e); 0 <= n && n <= 0x1f { // literal value 0x00-0x1f
+				a.code = 0x20 + byte(n)
+				return a
+			}
+		}
+		// next word (literal), which may be relaxed if it depends on labels
+		a.code, a.expr, a.relax = 0x1f, e, !isConst(e)
+		return a
+	}
+	p.nextImportant()
+	return a
+}
+
+// parseIndirect parses a bracketed operand like [A], [0x1000], [counter]
+// or [table+2*4+I]. The register may appear anywhere in the sum.
+func (p *Parser) parseIndirect(a *operand) {
+	lbrack := p.tok
+	p.nextImportant()
+	p.indirect = true
+	defer func() { p.indirect = false }() // also after syntax errors
+	e := p.parseExpr()
+	p.expect(token.RBRACK)
+	p.nextImportant()
+
+	reg, rest, err := splitRegister(e)
+	if err != nil {
+		// reported at the operand rather than at the token after it
+		panic(withPos(err, lbrack.Pos, lbrack.Macro))
+	}
+	// A constant zero offset is dropped, but an offset referencing labels
+	// always takes the next word, since it is only known after parsing.
+	if reg != "" && rest != nil && isConst(rest) && p.mustEval(rest) == 0 {
+		rest = nil
+	}
+	switch {
+	case reg != "" && rest != nil:
+		a.code = registerOpCode(reg) + 0x10
+	case reg != "":
+		a.code = registerOpCode(reg) + 0x08
+	default:
+		a.code = 0x1e
+	}
+	a.expr = rest
+}
+
+// parseData parses a DAT statement with a list of values.
+func (p *Parser) parseData() {
+	s := p.newStmt()
+	s.kind = stmtData
+	p.nextImportant()
+	s.data = append(s.data, p.parseExpr())
+	for p.tok.Tok == token.COMMA {
 		p.nextImportant()
+		s.data = append(s.data, p.parseExpr())
+	}
+}
 
-		var register string
-		lastOp := token.ADD
-		var nextWord uint16
-
-		FOR: for {
-			switch p.tok.Tok {
-			case token.INT:
-				n, err := strconv.ParseUint(p.tok.Lit, 0, 16)
-				if err != nil {
-					panic(err)
-				}
-				switch lastOp {
-				case token.ADD: nextWord += uint16(n)
-				case token.SUB: nextWord -= uint16(n)
-				default: p.unexpectedError()
-				}
-				lastOp = token.EMPTY
-			case token.REGISTER:
-				if register != "" {
-					p.expect(token.RBRACK)
-				}
-				register = p.tok.Lit
-				lastOp = token.EMPTY
-			case token.ADD:
-				lastOp = token.ADD
-			case token.SUB:
-				lastOp = token.SUB
-			case token.RBRACK:
-				switch {
-				case register != "" && nextWord != 0:
-					value = registerOpCode(register) + 0x10
-					p.gen = append(p.gen, nextWord)
-				case register != "":
-					value = registerOpCode(register) + 0x08
-				case nextWord != 0:
-					value = 0x1e
-					p.gen = append(p.gen, nextWord)
-				default:
-					p.unexpectedError()
-				}
-				p.nextImportant()
-				break FOR
-			default:
-				p.unexpectedError()
+// parseDirective parses an assembler directive.
+func (p *Parser) parseDirective() {
+	switch p.tok.Tok {
+	case token.DIR_EQU, token.DIR_DEFINE:
+		p.parseEqu()
+	case token.DIR_IF, token.DIR_IFDEF, token.DIR_IFNDEF, token.DIR_ELSE, token.DIR_ENDIF:
+		p.parseCond()
+	case token.DIR_INCLUDE:
+		p.parseInclude()
+	case token.DIR_INCBIN:
+		p.parseIncbin()
+	case token.DIR_SECTION:
+		p.parseSection()
+	case token.DIR_GLOBAL:
+		p.parseGlobal()
+	default:
+		p.parseLayout()
+	}
+}
+
+// parseEqu parses the definition of a named constant, which takes no
+// space and may be used in any expression. $ in the value is the address
+// of the definition. The value of .define defaults to 1, like -D.
+//
+//	.equ name, value
+//	.define name [value]
+func (p *Parser) parseEqu() {
+	dir := p.tok.Tok
+	p.newStmt().kind = stmtEqu
+	p.nextImportant()
+	if p.tok.Tok != token.IDENT {
+		p.expect(token.IDENT)
+	}
+	ident := p.tok
+	name, pos := p.tok.Lit, origin(p.tok.Pos, p.tok.Macro)
+	p.nextImportant()
+	if dir == token.DIR_DEFINE && (p.tok.Tok == token.EOF || !sameLine(p.tok, ident)) {
+		p.define(ident, &IntExpr{1})
+		p.symbols[name] = pos
+		return
+	}
+	if p.tok.Tok == token.COMMA {
+		p.nextImportant()
+	}
+	p.define(ident, p.parseExpr())
+	p.symbols[name] = pos
+}
+
+// define adds the constant named by ident to the symbol table. Conflicts
+// are reported at ident, since the value has been parsed already.
+func (p *Parser) define(ident TokenType, e Expr) {
+	name := ident.Lit
+	if _, ok := p.consts[name]; ok {
+		panic(withPos(errors.New(fmt.Sprintf(`assembler: symbol "%s" already defined!`, name)), ident.Pos, ident.Macro))
+	}
+	if _, ok := p.defs[name]; ok {
+		panic(withPos(errors.New(fmt.Sprintf(`assembler: label "%s" already defined!`, name)), ident.Pos, ident.Macro))
+	}
+	p.consts[name] = e
+}
+
+// parseSection parses .section name, which continues the named section.
+// The first section is "text".
+func (p *Parser) parseSection() {
+	p.nextImportant()
+	if p.tok.Tok != token.IDENT {
+		p.expect(token.IDENT)
+	}
+	p.endSection()
+	p.section = -1
+	for i, sec := range p.sections {
+		if sec.name == p.tok.Lit {
+			p.section = i
+		}
+	}
+	if p.section < 0 {
+		p.section = len(p.sections)
+		p.sections = append(p.sections, &section{name: p.tok.Lit, align: 1})
+	}
+	p.nextImportant()
+}
+
+// endSection ends the current part of a section, so that the labels
+// defined last belong to it rather than to the following section.
+func (p *Parser) endSection() {
+	p.newStmt().kind = stmtEnd
+}
+
+// parseGlobal parses .global name, ..., which exports labels and
+// constants from an object to other objects.
+func (p *Parser) parseGlobal() {
+	for {
+		p.nextImportant()
+		if p.tok.Tok != token.IDENT {
+			p.expect(token.IDENT)
+		}
+		g := p.tok
+		g.Lit = p.qualify(g.Lit)
+		p.globals = append(p.globals, g)
+		p.nextImportant()
+		if p.tok.Tok != token.COMMA {
+			return
+		}
+	}
+}
+
+// parseIncbin parses .incbin "file", which inserts the contents of a
+// binary file as big-endian words. An odd last byte is padded with zero.
+func (p *Parser) parseIncbin() {
+	p.nextImportant()
+	p.expect(token.STRING)
+	name, err := strconv.Unquote(p.tok.Lit)
+	if err != nil {
+		panic(err)
+	}
+	_, src, err := p.inc.read(name, p.tok.Pos)
+	if err != nil {
+		panic(err)
+	}
+	p.nextImportant()
+
+	w := make([]uint16, (len(src)+1)/2)
+	words.CopyFromBytes(w, src)
+	s := p.newStmt()
+	s.kind = stmtData
+	s.data = make([]Expr, len(w))
+	for i, v := range w {
+		s.data[i] = &IntExpr{int(v)}
+	}
+}
+
+// parseCond parses the directives of conditional assembly:
+//
+//	.if expr       assemble the following block if expr is not zero
+//	.ifdef name    ... if name is a defined symbol or label
+//	.ifndef name   ... if name is not defined
+//	.else
+//	.endif
+//
+// The condition of .if must be known when it is parsed, so it may only
+// refer to constants defined before. Blocks that are not assembled are
+// skipped without being parsed.
+func (p *Parser) parseCond() {
+	dir := p.tok.Tok
+	p.nextImportant()
+	switch dir {
+	case token.DIR_IF:
+		// An invalid condition still opens a block, so that its
+		// .else and .endif are not reported as well.
+		defer func() {
+			if r := recover(); r != nil {
+				p.conds = append(p.conds, false)
+				panic(r)
 			}
-			p.nextImportant()
+		}()
+		cond := p.parseConst(dir, -0x80000000, 0x7fffffff) != 0
+		p.enterCond(cond)
+	case token.DIR_IFDEF, token.DIR_IFNDEF:
+		if p.tok.Tok != token.IDENT {
+			p.expect(token.IDENT)
 		}
-	} else {
+		_, isConst := p.consts[p.tok.Lit]
+		_, isLabel := p.defs[p.qualify(p.tok.Lit)]
+		p.nextImportant()
+		p.enterCond((isConst || isLabel) == (dir == token.DIR_IFDEF))
+	case token.DIR_ELSE:
+		if len(p.conds) == 0 {
+			panic(errors.New("assembler: .else without .if"))
+		}
+		if p.conds[len(p.conds)-1] {
+			panic(errors.New("assembler: .else after .else"))
+		}
+		// the .if block was assembled, so skip the .else block
+		p.conds[len(p.conds)-1] = true
+		switch p.skipCond() {
+		case token.DIR_ELSE:
+			panic(errors.New("assembler: .else after .else"))
+		case token.DIR_ENDIF:
+			p.conds = p.conds[:len(p.conds)-1]
+		}
+	case token.DIR_ENDIF:
+		if len(p.conds) == 0 {
+			panic(errors.New("assembler: .endif without .if"))
+		}
+		p.conds = p.conds[:len(p.conds)-1]
+	}
+}
+
+// enterCond starts a conditional block and skips to its .else
+// branch if cond is false.
+func (p *Parser) enterCond(cond bool) {
+	p.conds = append(p.conds, false)
+	if cond {
+		return
+	}
+	switch p.skipCond() {
+	case token.DIR_ELSE:
+		p.conds[len(p.conds)-1] = true
+	case token.DIR_ENDIF:
+		p.conds = p.conds[:len(p.conds)-1]
+	}
+}
+
+// skipCond skips tokens up to the .else or .endif that belongs to the
+// current conditional block and returns which one was found.
+func (p *Parser) skipCond() token.Token {
+	depth := 0
+	for {
 		switch p.tok.Tok {
-		case token.POP: value = 0x18
-		case token.PEEK: value = 0x19
-		case token.PUSH: value = 0x1a
-		case token.SP: value = 0x1b
-		case token.PC: value = 0x1c
-		case token.O: value = 0x1d
-		case token.REGISTER: value = registerOpCode(p.tok.Lit)
-		case token.IDENT:
-			value = 0x1f
-			p.fixlabels = append(p.fixlabels, FixLabel{uint16(len(p.gen)), p.tok.Lit})
-			p.gen = append(p.gen, 0x0000)
-		case token.INT:
-			n, err := strconv.ParseUint(p.tok.Lit, 0, 16)
-			if err != nil {
-				panic(err)
+		case token.EOF:
+			return token.EOF // reported by parseStatements
+		case token.DIR_IF, token.DIR_IFDEF, token.DIR_IFNDEF:
+			depth++
+		case token.DIR_ELSE:
+			if depth == 0 {
+				p.nextImportant()
+				return token.DIR_ELSE
 			}
-			if n <= 0x1f { // literal value 0x00-0x1f
-				value = 0x20 + byte(n)
-			} else { // next word (literal)
-				value = 0x1f
-				p.gen = append(p.gen, uint16(n))
+		case token.DIR_ENDIF:
+			if depth == 0 {
+				p.nextImportant()
+				return token.DIR_ENDIF
 			}
-		default:
-			p.unexpectedError()
+			depth--
+		}
+		p.nextImportant()
+	}
+}
+
+// parseLayout parses a layout directive:
+//
+//	.org address          continue at address
+//	.align n [, value]    pad with value to the next multiple of n
+//	.fill count [, value] insert count words of value
+//	.reserve count        reserve count uninitialized words
+//
+// The padding value defaults to zero.
+func (p *Parser) parseLayout() {
+	s := p.newStmt()
+	start, dir := p.tok, p.tok.Tok
+	if dir == token.DIR_ORG && p.object {
+		panic(errors.New("assembler: .org cannot be used in relocatable objects"))
+	}
+	p.nextImportant()
+	switch dir {
+	case token.DIR_ORG:
+		s.kind = stmtOrg
+		s.count = p.parseConst(dir, 0, 0xffff)
+	case token.DIR_ALIGN:
+		s.kind = stmtAlign
+		s.count = p.parseConst(dir, 1, 0x10000)
+		sec := p.sections[p.section]
+		if sec.align = lcm(sec.align, s.count); sec.align > 0x10000 {
+			panic(withPos(errors.New(fmt.Sprintf("assembler: alignment of section %s exceeds the address space", sec.name)), start.Pos, start.Macro))
 		}
+		if p.object && sec.align > 0x8000 { // stored as a word in objects
+			panic(withPos(errors.New(fmt.Sprintf("assembler: alignment of section %s exceeds 0x8000 in relocatable objects", sec.name)), start.Pos, start.Macro))
+		}
+	case token.DIR_FILL:
+		s.kind = stmtFill
+		s.count = p.parseConst(dir, 0, 0x10000)
+	case token.DIR_RESERVE:
+		s.kind = stmtReserve
+		s.count = p.parseConst(dir, 0, 0x10000)
+		return
+	}
+	if s.kind != stmtOrg && p.tok.Tok == token.COMMA {
 		p.nextImportant()
+		s.fill = p.parseExpr()
 	}
+}
 
-	return
+// lcm returns the least common multiple of a and b.
+func lcm(a, b int) int {
+	x, y := a, b
+	for y != 0 {
+		x, y = y, x%y
+	}
+	return a / x * b
 }
 
+// parseConst parses the constant argument of a directive, which
+// must lie between min and max. Errors are reported at the start of the
+// argument rather than at the token after it.
+func (p *Parser) parseConst(dir token.Token, min, max int) int {
+	start := p.tok
+	e := p.parseExpr()
+	if l := p.undefinedLabel(e); l != nil {
+		panic(withPos(errors.New(fmt.Sprintf("assembler: undefined symbol %s", l.Name)), l.Pos, l.macro))
+	}
+	if !isConst(e) {
+		panic(withPos(errors.New(fmt.Sprintf("assembler: %s requires a constant, got %s", dir, e)), start.Pos, start.Macro))
+	}
+	n, err := p.eval(e)
+	if err != nil {
+		panic(withPos(err, start.Pos, start.Macro))
+	}
+	if n < min || n > max {
+		panic(withPos(errors.New(fmt.Sprintf("assembler: %s %#x out of range %#x-%#x", dir, n, min, max)), start.Pos, start.Macro))
+	}
+	return n
+}
+
+// Parse parses the tokens and generates machine code. Parsing continues
+// after errors, so that all of them are returned as an ErrorList.
 func (p *Parser) Parse(tokens []TokenType) (gen []uint16, err error) {
 	defer func() {
 		if r:= recover(); r != nil {
-			if _, ok := r.(runtime.Error); ok {
+			if isRuntimeError(r) {
 				panic(r)
 			}
-			err = r.(error)
+			if p.cur != nil {
+				p.errors.Add(withPos(r.(error), p.cur.pos, p.cur.macro))
+			} else {
+				p.errors.Add(withPos(r.(error), p.tok.Pos, p.tok.Macro))
+			}
+			gen, err = nil, p.errors
 		}
 	}()
 
 	p.tokens = tokens
 	p.offset = -1
 	p.gen = make([]uint16, 0)
-	p.pc = 0
+	p.stmts = make([]*stmt, 0)
+	p.defs = make(map[string]int)
 	p.labels = make(map[string]uint16)
+	p.consts = make(map[string]Expr)
+	p.resolving = make(map[string]bool)
+	p.conds = make([]bool, 0)
 	p.fixlabels = make([]FixLabel, 0)
+	p.errors = nil
+	p.sections = []*section{{name: "text", align: 1}}
+	p.section = 0
+	p.globals = nil
+	p.relocs = make([]uint16, 0)
+	p.symbols = make(map[string]token.Position)
+	p.refs = make(map[string][]token.Position)
+	if p.object || p.relocatable {
+		p.noRelax = true // label values are only known when linking or loading
+	}
+	for name, v := range p.defines {
+		p.consts[name] = &IntExpr{v}
+		p.symbols[name] = token.Position{}
+	}
+	if p.inc == nil {
+		p.inc = &includer{}
+	}
+	p.pp = &preprocessor{inc: p.inc, macros: make(map[string]*macro)}
+	p.includes = nil
 
+	p.parseStatements()
+	if p.layout(); len(p.errors) > 0 {
+		return nil, p.errors
+	}
+	p.emit()
+	if p.object {
+		p.buildObject()
+	}
+	return p.gen, nil
+}
+
+// parseStatements parses all tokens into statements.
+func (p *Parser) parseStatements() {
 	p.nextImportant()
-	FOR: for {
-		switch {
-		case p.tok.Tok.IsOp():
-			p.parseOp()
-		case p.tok.Tok == token.EOF:
-			break FOR
-		case p.tok.Tok == token.LABEL:
-			if _, ok := p.labels[p.tok.Lit]; ok {
-				return nil, errors.New(fmt.Sprintf(`assembler: label "%s" already defined!`, p.tok.Lit))
+	for p.tok.Tok != token.EOF {
+		p.parseStatement()
+	}
+	p.endSection()
+	if len(p.conds) > 0 {
+		p.errors.Add(withPos(errors.New("assembler: missing .endif"), p.tok.Pos, p.tok.Macro))
+	}
+}
+
+// parseStatement parses a label or a statement. Errors are recorded with
+// the position they occurred at, and parsing resumes on the next line.
+func (p *Parser) parseStatement() {
+	start, offset, n := p.tok, p.offset, len(p.stmts)
+	defer func() {
+		if r := recover(); r != nil {
+			err, ok := r.(error)
+			if !ok || isRuntimeError(r) {
+				panic(r)
+			}
+			p.errors.Add(withPos(err, p.tok.Pos, p.tok.Macro))
+			p.stmts = p.stmts[:n] // drop the incomplete statement
+			if p.offset == offset {
+				p.nextImportant()
+			}
+			for p.tok.Tok != token.EOF && sameLine(p.tok, start) {
+				p.nextImportant()
 			}
-			p.labels[p.tok.Lit] = uint16(len(p.gen))
-			p.nextImportant()
-		default:
-			p.unexpectedError();
 		}
+	}()
+
+	switch {
+	case p.tok.Tok == token.DIR_MACRO:
+		p.offset = p.pp.define(p.tokens, p.offset)
+		p.nextImportant()
+	case p.tok.Tok == token.DIR_ENDM:
+		panic(errors.New("assembler: .endm without .macro"))
+	case p.tok.Tok == token.IDENT && p.pp.macros[p.tok.Lit] != nil:
+		body, last := p.pp.expand(p.pp.macros[p.tok.Lit], p.tokens, p.offset)
+		p.splice(last, body)
+	case p.tok.Tok.IsOp():
+		p.parseOp()
+	case p.tok.Tok == token.OP_DAT:
+		p.parseData()
+	case p.tok.Tok.IsDirective():
+		p.parseDirective()
+	case p.tok.Tok == token.LABEL:
+		p.defineLabel(p.tok.Lit)
+		p.nextImportant()
+	default:
+		p.unexpectedError();
 	}
+}
 
-	for _, fix := range p.fixlabels {
-		offset, ok := p.labels[fix.Label]
-		if !ok {
-			return nil, errors.New(fmt.Sprintf(`assembler: undefined label "%s"!`, p.tok.Lit))
-		}
-		p.gen[fix.Offset] = offset
+// sameLine reports whether two tokens stem from the same source line
+// of the same macro expansion.
+func sameLine(a, b TokenType) bool {
+	return a.Pos.Line == b.Pos.Line && a.Pos.Filename == b.Pos.Filename && a.Macro == b.Macro
+}
+
+// defineLabel defines a label at the current statement. Local labels are
+// qualified with the preceding global label, and anonymous labels are
+// numbered in order as ":1", ":2", ...
+func (p *Parser) defineLabel(name string) {
+	switch {
+	case name == "":
+		p.anons++
+		name = ":" + strconv.Itoa(p.anons)
+	case isLocal(name):
+		name = p.qualify(name)
+	case !strings.Contains(name, "@"): // labels local to macros keep the scope
+		p.scope = name
+	}
+	if _, ok := p.defs[name]; ok {
+		panic(errors.New(fmt.Sprintf(`assembler: label "%s" already defined!`, name)))
+	}
+	if _, ok := p.consts[name]; ok {
+		panic(errors.New(fmt.Sprintf(`assembler: symbol "%s" already defined!`, name)))
 	}
+	p.defs[name] = len(p.stmts)
+	p.symbols[name] = origin(p.tok.Pos, p.tok.Macro)
+}
 
-	return p.gen, nil
+// isLocal reports whether name is a local label like ".loop" or "_loop".
+func isLocal(name string) bool {
+	return strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")
 }
 
+// qualify returns the full name of a label reference. Local labels belong
+// to the preceding global label, so ".loop" after "main" is "main.loop"
+// and "_loop" is "main._loop". Local labels before the first global
+// label keep their name.
+func (p *Parser) qualify(name string) string {
+	switch {
+	case !isLocal(name) || p.scope == "":
+		return name
+	case name[0] == '.':
+		return p.scope + name
+	}
+	return p.scope + "." + name
+}
+
+// anonLabel returns the name of the anonymous label referenced by ":-"
+// (the previous one), ":--" (the one before), ":+" (the next one) and so on.
+func (p *Parser) anonLabel(ref string) string {
+	n := p.anons + len(ref)
+	if ref[0] == '-' {
+		n = p.anons - len(ref) + 1
+	}
+	if n < 1 {
+		panic(errors.New("assembler: no anonymous label for :" + ref))
+	}
+	return ":" + strconv.Itoa(n)
+}
+
+func isRuntimeError(r interface{}) bool {
+	_, ok := r.(runtime.Error)
+	return ok
+}
+
+// Config controls optional behaviour of the assembler.
+type Config struct {
+	// Warnings receives non-fatal diagnostics, such as values that
+	// overflow a word. They are discarded if Warnings is nil.
+	Warnings io.Writer
+
+	// NoRelax disables shrinking label operands into short literals,
+	// so that every instruction keeps the size it was parsed with.
+	NoRelax bool
+
+	// Defines are named constants that are predefined as if
+	// by .equ, for example to select variants with .ifdef.
+	Defines map[string]int
+
+	// IncludePaths are searched for files of .include and .incbin
+	// that are not found relative to the including file.
+	IncludePaths []string
+
+	// Listing receives the source lines with the address and words they
+	// generated, followed by a table of all symbols, if the source is
+	// assembled without errors.
+	Listing io.Writer
+
+	// Symbols, if not nil, is set to the labels of the program.
+	Symbols *symbols.Map
+	// SourceMap, if not nil, is set to the source lines of the program.
+	SourceMap *sourcemap.Map
+	// Constants, if not nil, is set to the values of the named constants.
+	Constants *map[string]uint16
+}
+
+// Assemble converts assembler source into machine code using the
+// default configuration.
 func Assemble(src []byte) (gen []uint16, err error) {
+	return (&Config{}).Assemble(src)
+}
+
+// Assemble converts assembler source into machine code. Included files
+// are searched relative to the working directory.
+func (c *Config) Assemble(src []byte) (gen []uint16, err error) {
+	return c.assemble(src, "")
+}
+
+// AssembleFile converts the assembler source file into machine code.
+func (c *Config) AssembleFile(filename string) (gen []uint16, err error) {
+	src, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return c.assemble(src, filename)
+}
+
+// AssembleObject converts assembler source into a relocatable object,
+// which is combined with other objects by the linker. Labels and constants
+// listed by .global are exported, and symbols which are not defined are
+// imported from other objects. Since the addresses are only known when
+// linking, label operands are not relaxed and .org cannot be used.
+func (c *Config) AssembleObject(src []byte) (*object.File, error) {
+	p, err := c.parse(src, "", true, false)
+	if err != nil {
+		return nil, err
+	}
+	return p.obj, nil
+}
+
+// AssembleObjectFile converts the assembler source file into a
+// relocatable object.
+func (c *Config) AssembleObjectFile(filename string) (*object.File, error) {
+	src, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	p, err := c.parse(src, filename, true, false)
+	if err != nil {
+		return nil, err
+	}
+	return p.obj, nil
+}
+
+// AssembleRelocatable converts assembler source into a program which can
+// be loaded at any address. Like with objects, label operands are not relaxed.
+// Words that hold the address of a label are listed as relocations. Since
+// the whole program moves, this includes labels placed with .org.
+func (c *Config) AssembleRelocatable(src []byte) (*loader.Program, error) {
+	p, err := c.parse(src, "", false, true)
+	if err != nil {
+		return nil, err
+	}
+	return &loader.Program{Image: p.gen, Relocs: p.relocs}, nil
+}
+
+// AssembleRelocatableFile converts the assembler source file into a
+// program which can be loaded at any address.
+func (c *Config) AssembleRelocatableFile(filename string) (*loader.Program, error) {
+	src, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	p, err := c.parse(src, filename, false, true)
+	if err != nil {
+		return nil, err
+	}
+	return &loader.Program{Image: p.gen, Relocs: p.relocs}, nil
+}
+
+func (c *Config) assemble(src []byte, filename string) (gen []uint16, err error) {
+	p, err := c.parse(src, filename, false, false)
+	if err != nil {
+		return nil, err
+	}
+	return p.gen, nil
+}
+
+// parse preprocesses and parses the source, which produces machine code,
+// a relocatable program or an object.
+func (c *Config) parse(src []byte, filename string, obj, reloc bool) (p *Parser, err error) {
+	inc := &includer{paths: c.IncludePaths, sources: map[string][]byte{filename: src}}
+	if filename != "" {
+		inc.stack = append(inc.stack, filename)
+	}
+	p = &Parser{warnings: c.Warnings, noRelax: c.NoRelax, defines: c.Defines, inc: inc,
+		object: obj, relocatable: reloc}
+	_, err = p.Parse(scan(src, filename))
+	if err == nil && c.Listing != nil {
+		err = p.writeListing(c.Listing, inc)
+	}
+	if err == nil && c.Symbols != nil {
+		*c.Symbols = p.symbolMap()
+	}
+	if err == nil && c.SourceMap != nil {
+		*c.SourceMap = p.sourceMap()
+	}
+	if err == nil && c.Constants != nil {
+		*c.Constants = p.constants()
+	}
+	if e, ok := err.(*Error); ok {
+		err = ErrorList{e}
+	}
+	if list, ok := err.(ErrorList); ok {
+		for _, e := range list {
+			e.Source = inc.line(e.Pos)
+		}
+	}
+	return p, err
+}
+
+// scan splits src into tokens, which are positioned in the named file.
+func scan(src []byte, filename string) []TokenType {
 	s := &scanner.Scanner{}
-	s.Init(src)
+	s.InitFile(filename, src)
 
 	tokens := make([]TokenType, 0)
 	for {
 		tok, lit := s.Scan()
-		tokens = append(tokens, TokenType{tok, lit})
+		tokens = append(tokens, TokenType{tok, lit, s.Pos(), nil})
 		if tok == token.EOF {
 			break
 		}
 	}
-
-	parser := &Parser{}
-	gen, err = parser.Parse(tokens)
-	return
+	return tokens
 }
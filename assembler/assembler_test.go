@@ -1,6 +1,14 @@
 package assembler
 
 import (
+	"github.com/xconstruct/dcpu16/sourcemap"
+	"github.com/xconstruct/dcpu16/symbols"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -16,8 +24,7 @@ func expect(t *testing.T, got, exp []uint16) {
 	}
 }
 
-func TestBasic(t *testing.T) {
-	gen, err := Assemble([]byte(`
+const notchSrc = `
 ;Notch's examples
 ;Should compile fine, by default
 
@@ -48,7 +55,11 @@ func TestBasic(t *testing.T) {
 								
 ;Hang forever. X should now be 0x40 if everything went right.
 :crash	SET PC, crash			; 7dc1 001a [*]
-	`))
+	`
+
+func TestBasic(t *testing.T) {
+	c := &Config{NoRelax: true}
+	gen, err := c.Assemble([]byte(notchSrc))
 
 	if err != nil {
 		t.Fatal(err)
@@ -60,3 +71,645 @@ func TestBasic(t *testing.T) {
 		0x9037, 0x61c1, 0x7dc1, 0x001a,
 	})
 }
+
+func TestRelax(t *testing.T) {
+	gen, err := Assemble([]byte(notchSrc))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, gen, []uint16{
+		0x7c01, 0x0030, 0x7de1, 0x1000, 0x0020, 0x7803, 0x1000, 0xc00d,
+		0xd9c1, 0xa861, 0x7c01, 0x2000, 0x2161, 0x2000, 0x8463, 0x806d,
+		0xb1c1, 0x9031, 0xd010, 0xd9c1, 0x9037, 0x61c1, 0xd9c1,
+	})
+
+	// Relaxing would move end and make the operand overflow again,
+	// so it has to stay a next word.
+	gen, err = Assemble([]byte(`
+		SET A, 0x21 - end
+:end`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, gen, []uint16{0x7c01, 0x001f})
+}
+
+func TestExpressions(t *testing.T) {
+	gen, err := Assemble([]byte(`
+		SET A, buffer_end - buffer    ; 8c01
+		SET B, (1 << 4) | 0x0f ^ 3    ; f011
+		SET C, -1                     ; 7c21 ffff
+		SET [table + 2*4 + I], ~0     ; 7d61 0010 ffff
+		SET PC, $                     ; 9dc1
+:table	DAT 10 % 4, 7 / 2, table      ; 0002 0003 0008
+:buffer	DAT 1, 2, 3
+:buffer_end
+	`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, gen, []uint16{
+		0x8c01, 0xf011, 0x7c21, 0xffff, 0x7d61, 0x0010, 0xffff, 0x9dc1,
+		0x0002, 0x0003, 0x0008, 0x0001, 0x0002, 0x0003,
+	})
+}
+
+func TestExpressionErrors(t *testing.T) {
+	for _, src := range []string{
+		`SET A, 1/0`,
+		`SET A, undefined`,
+		`SET A, [B+C]`,
+		`SET A, [0x10-I]`,
+		`SET A, [2*I]`,
+		`SET A, (1 + 2`,
+	} {
+		if _, err := Assemble([]byte(src)); err == nil {
+			t.Errorf("%s: expected error", src)
+		}
+	}
+}
+
+func TestOverflowWarning(t *testing.T) {
+	var buf bytes.Buffer
+	c := &Config{Warnings: &buf}
+	gen, err := c.Assemble([]byte(`DAT 0x12345, label * 0x8000
+:label`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, gen, []uint16{0x2345, 0x0000})
+	if n := strings.Count(buf.String(), "overflows"); n != 2 {
+		t.Errorf("expected 2 overflow warnings, got %d: %s", n, buf.String())
+	}
+}
+
+func TestIndirectLabels(t *testing.T) {
+	gen, err := Assemble([]byte(`
+:zero	SET [mylabel+I], 1         ; 8561 000c
+		SET A, [counter]           ; 7801 000d
+		SET [I+mylabel+1], [zero]  ; 7961 000d 0000
+		SET B, [counter-1+J]       ; 5c11 000c
+		SET [zero+X], [mylabel]    ; 7931 0000 000c
+:mylabel DAT 0
+:counter DAT 0
+	`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, gen, []uint16{
+		0x8561, 0x000c, 0x7801, 0x000d, 0x7961, 0x000d, 0x0000, 0x5c11,
+		0x000c, 0x7931, 0x0000, 0x000c, 0x0000, 0x0000,
+	})
+}
+
+func TestLayoutDirectives(t *testing.T) {
+	gen, err := Assemble([]byte(`
+		SET PC, start
+.org 0x10
+:vectors DAT handler
+.align 8, 0xdead
+:start	SET A, 1
+		SET PC, start
+:handler SET PC, POP
+.fill 3, 0x1111
+.reserve 2
+.org 0x30
+:buffer	.reserve 4
+:end	DAT end - buffer
+	`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := make([]uint16, 0x35)
+	exp[0x00] = 0xe1c1
+	exp[0x10] = 0x001a
+	for i := 0x11; i < 0x18; i++ {
+		exp[i] = 0xdead
+	}
+	exp[0x18], exp[0x19], exp[0x1a] = 0x8401, 0xe1c1, 0x61c1
+	exp[0x1b], exp[0x1c], exp[0x1d] = 0x1111, 0x1111, 0x1111
+	exp[0x34] = 0x0004
+	expect(t, gen, exp)
+}
+
+func TestLayoutErrors(t *testing.T) {
+	for _, src := range []string{
+		".org 0x10\nDAT 1\n.org 0x10\nDAT 2",
+		".org label\n:label",
+		".align 0",
+		".fill 0x10001",
+		".org 0xffff\nDAT 1, 2",
+	} {
+		if _, err := Assemble([]byte(src)); err == nil {
+			t.Errorf("%q: expected error", src)
+		}
+	}
+}
+
+func TestConstants(t *testing.T) {
+	c := &Config{Defines: map[string]int{"TARGET": 17}}
+	gen, err := c.Assemble([]byte(`
+.equ SCREEN, 0x8000
+.define ROWS 12
+.equ size, end - start
+:start	SET [SCREEN + ROWS*32 + I], size
+		SET A, later
+.equ later, ROWS - 2
+.if TARGET >= 17
+		SET B, 1
+.ifdef DEBUG
+		SET C, 1
+.else
+		SET C, 2
+.endif
+.else
+		SET B, 0
+.endif
+.ifndef start
+		SET X, 1
+.endif
+:end
+	`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, gen, []uint16{0x9561, 0x8180, 0xa801, 0x8411, 0x8821})
+
+	// $ is the address of the definition
+	gen, err = Assemble([]byte(".equ FIRST, $\nSET A, 1\n.equ HERE, $\nSET B, HERE\nSET C, FIRST"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, gen, []uint16{0x8401, 0x8411, 0x8021})
+
+	// .define without a value defines 1
+	gen, err = Assemble([]byte(".define DEBUG\n.ifdef DEBUG\nSET A, DEBUG\n.endif\n.define TRACE ; no value\nSET B, TRACE"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, gen, []uint16{0x8401, 0x8411})
+}
+
+func TestConstantErrors(t *testing.T) {
+	for _, src := range []string{
+		".equ X, 1\n.equ X, 2",
+		":X\n.equ X, 1",
+		".equ X, 1\n:X",
+		".equ X, Y\n.equ Y, X\nDAT X",
+		".if 1\nDAT 1",
+		".else",
+		".endif",
+		".if 0\n.else\n.else\n.endif",
+		".if 1\n.else\n.else\n.endif",
+		".if label\n.endif\n:label",
+	} {
+		if _, err := Assemble([]byte(src)); err == nil {
+			t.Errorf("%q: expected error", src)
+		}
+	}
+}
+
+func TestMacros(t *testing.T) {
+	gen, err := Assemble([]byte(`
+.macro push2 first, second
+		SET PUSH, first
+		SET PUSH, second
+.endm
+.macro countdown reg, from  ; local label per expansion
+		SET reg, from
+:again	SUB reg, 1
+		IFN reg, 0
+			SET PC, again
+.endm
+.macro func name
+:name	push2 X, Y
+.endm
+
+		push2 A, [B+1]
+		countdown I, 3
+:f		func entry
+		countdown J, 2
+		SET PC, entry
+	`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, gen, []uint16{
+		0x01a1, 0x45a1, 0x0001, 0x8c61, 0x8463, 0x806d, 0x91c1, 0x0da1,
+		0x11a1, 0x8871, 0x8473, 0x807d, 0xa9c1, 0x9dc1,
+	})
+
+	// definitions in blocks that are not assembled are skipped
+	gen, err = Assemble([]byte(`
+.if 0
+.macro m
+		SET A, 1
+.endm
+.else
+.macro m
+		SET A, 2
+.endm
+.endif
+.ifdef UNDEFINED
+		m
+.endif
+		m
+	`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, gen, []uint16{0x8801})
+}
+
+func TestMacroErrors(t *testing.T) {
+	for _, c := range []struct{ src, msg string }{
+		{".macro m x\n.endm", "1:10: invalid macro parameter"},
+		{".macro m\nDAT 1", `1:1: missing .endm for macro "m"`},
+		{".macro m\n.endm\n.macro m\n.endm", `3:8: macro "m" already defined`},
+		{".endm", "1:1: .endm without .macro"},
+		{".if 0\n.macro m\n.endm\n.endif\n\tm", "5:2: unexpected"},
+		{".macro m one, two\n.endm\n\tm 1", "3:2: macro expects 2 arguments, got 1\n" +
+			"\t\tm 1\n\t\t^\n" +
+			"\tin macro \"m\" defined at 1:1, called at 3:2"},
+		{".macro m\n\tm\n.endm\n\tm", "macro invocations nested too deeply"},
+		{".macro m arg\n\tSET A, arg\n.endm\n:l\tm B+\n", "2:9: unexpected '+'\n" +
+			"\t\tSET A, arg\n\t\t       ^\n" +
+			"\tin macro \"m\" defined at 1:1, called at 4:4"},
+	} {
+		_, err := Assemble([]byte(c.src))
+		if err == nil || !strings.Contains(err.Error(), c.msg) {
+			t.Errorf("%q: expected error %q, got %v", c.src, c.msg, err)
+		}
+	}
+}
+
+// writeFiles creates the files in a temporary directory and returns it.
+func writeFiles(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "dcpu-asm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestInclude(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.dasm":       ".include \"lib/math.dasm\"\n\t\tJSR double\n:font\t.incbin \"font.bin\"\n",
+		"lib/math.dasm":   ".include \"macros.dasm\"\n:double\tSHL A, 1\n\t\tret\n",
+		"inc/macros.dasm": ".macro ret\n\t\tSET PC, POP\n.endm\n",
+		"inc/font.bin":    "\x12\x34\x56",
+	})
+	defer os.RemoveAll(dir)
+
+	c := &Config{IncludePaths: []string{filepath.Join(dir, "inc")}}
+	gen, err := c.AssembleFile(filepath.Join(dir, "main.dasm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, gen, []uint16{0x8407, 0x61c1, 0x8010, 0x1234, 0x5600})
+
+	// files in blocks that are not assembled are not included
+	dir = writeFiles(t, map[string]string{
+		"main.dasm": ".ifdef DEBUG\n.include \"missing.dasm\"\n.include \"debug.dasm\"\n.endif\n" +
+			".include \"lib.dasm\"\n.include \"lib.dasm\"\n.ifdef debug\nSET B, 1\n.endif\n",
+		"debug.dasm": ":debug SET A, 1\n",
+		"lib.dasm":   ".ifndef LIB\n.define LIB\n:lib SET C, 1\n.endif\n",
+	})
+	defer os.RemoveAll(dir)
+	gen, err = (&Config{}).AssembleFile(filepath.Join(dir, "main.dasm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, gen, []uint16{0x8421})
+
+	// the arguments of a macro invoked in an included macro end with
+	// its line, even if the including file continues on a line with the
+	// same number
+	dir = writeFiles(t, map[string]string{
+		"main.dasm": "\n.include \"defs.dasm\"\n\n\n\n\touter\n\tSET B, 2\n",
+		"defs.dasm": ".macro inner\n\tSET A, 1\n.endm\n\n.macro outer\n\tSET C, 3\n\tinner\n.endm\n",
+	})
+	defer os.RemoveAll(dir)
+	gen, err = (&Config{}).AssembleFile(filepath.Join(dir, "main.dasm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, gen, []uint16{0x8c21, 0x8401, 0x8811})
+}
+
+func TestIncludeErrors(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.dasm":       ".include \"b.dasm\"\n",
+		"b.dasm":       "\n.include \"a.dasm\"\n",
+		"missing.dasm": ".incbin \"nothing.bin\"\n",
+		"bad.dasm":     "DAT 1\n.include \"error.dasm\"\n",
+		"error.dasm":   "\n\nSET A, )\n",
+	})
+	defer os.RemoveAll(dir)
+
+	for name, msg := range map[string]string{
+		"a.dasm":       "b.dasm:2:10: include cycle",
+		"missing.dasm": `missing.dasm:1:9: cannot find file "nothing.bin"`,
+		"bad.dasm":     "error.dasm:3:8: unexpected ')'\n\tSET A, )\n\t       ^",
+	} {
+		_, err := (&Config{}).AssembleFile(filepath.Join(dir, name))
+		if err == nil || !strings.Contains(err.Error(), msg) {
+			t.Errorf("%s: expected error %q, got %v", name, msg, err)
+		}
+	}
+}
+
+func TestLocalLabels(t *testing.T) {
+	p := &Parser{}
+	gen, err := p.Parse(scan([]byte(`
+:main	SET I, 3
+:.loop	SUB I, 1
+		IFN I, 0
+			SET PC, .loop
+		SET PC, other.loop
+:other	SET J, 2
+:.loop	SUB J, 1
+:_skip	IFN J, 0
+			SET PC, .loop
+		SET PC, _skip
+:		SET A, 1
+		SET PC, :-
+		SET PC, :+
+:		SET B, :--
+	`), ""))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, gen, []uint16{
+		0x8c61, 0x8463, 0x806d, 0x85c1, 0x99c1, 0x8871, 0x8473, 0x807d,
+		0x99c1, 0x9dc1, 0x8401, 0xa9c1, 0xb5c1, 0xa811,
+	})
+	for name, addr := range map[string]uint16{
+		"main": 0, "main.loop": 1, "other": 5, "other.loop": 6, "other._skip": 7,
+	} {
+		if got, ok := p.labels[name]; !ok || got != addr {
+			t.Errorf("label %s: expected %#04x, got %#04x (defined: %v)", name, addr, got, ok)
+		}
+	}
+
+	for _, src := range []string{
+		":main\n:.loop\n:.loop",
+		"SET PC, :-\n:",
+		":\nSET PC, :+",
+		":main\nSET PC, .loop\n:other\n:.loop",
+	} {
+		if _, err := Assemble([]byte(src)); err == nil {
+			t.Errorf("%q: expected error", src)
+		}
+	}
+}
+
+func TestErrorPositions(t *testing.T) {
+	for _, c := range []struct{ src, msg string }{
+		{"\tSET A, 1\n\tSET PC, missing\n", "2:10: undefined label \"missing\"\n" +
+			"\t\tSET PC, missing\n\t\t        ^"},
+		{"SET A, 1/0", "1:11: division by zero"},
+		{"SET A, B\n  :x SET [A+B], 1", "2:10: a register can only be added once"},
+		{"SET A, [B+C]\nSET X, 1", "1:8: a register can only be added once"},
+		{"SET A, [B+)]\nSET A, 1+B", "2:10: unexpected REGISTER"},
+		{"DAT 1\n\n SET A,", "3:8: unexpected EOF"},
+		{":a\n:a", `2:1: label "a" already defined`},
+		{"DAT 1\n.org 0x10001\nDAT 2", "2:6: .org 0x10001 out of range 0x0-0xffff\n\t.org 0x10001\n\t     ^"},
+		{".fill 2, 0\n.fill 1/0\nDAT 1", "2:7: division by zero"},
+		{".align 0x8000\n.align 3\nDAT 1", "2:1: alignment of section text exceeds the address space"},
+		{".if VERSION == 17\n.endif\nDAT 1", "1:5: undefined symbol VERSION"},
+		{"DAT 1\n.if 1 + MISSING\n.endif", "2:9: undefined symbol MISSING"},
+		{":start\n.if start\n.endif", "2:5: .if requires a constant, got start"},
+		{".equ N, 1\n.equ N, 2\nDAT N", `2:6: symbol "N" already defined`},
+	} {
+		_, err := Assemble([]byte(c.src))
+		if err == nil || !strings.Contains(err.Error(), c.msg) {
+			t.Errorf("%q: expected error %q, got %v", c.src, c.msg, err)
+		}
+	}
+}
+
+func TestMultipleErrors(t *testing.T) {
+	src := `
+	SET A, )
+	SET B, 0x
+	SET PC, missing
+:dup	SET C, 1
+:dup	SET X, 2
+.if undefined
+	DAT 1
+.endif
+	DAT also_missing, 1/0
+`
+	_, err := Assemble([]byte(src))
+	list, ok := err.(ErrorList)
+	if !ok {
+		t.Fatalf("expected an ErrorList, got %v", err)
+	}
+	msgs := []string{
+		"2:9: unexpected ')'",
+		"3:9: invalid number 0x",
+		`6:1: label "dup" already defined`,
+		"7:5: undefined symbol undefined",
+		`4:10: undefined label "missing"`,
+		`10:6: undefined label "also_missing"`,
+		"10:2: division by zero",
+	}
+	if len(list) != len(msgs) {
+		t.Fatalf("expected %d errors, got %d:\n%v", len(msgs), len(list), err)
+	}
+	for i, msg := range msgs {
+		if !strings.Contains(list[i].Error(), msg) {
+			t.Errorf("error %d: expected %q, got %q", i, msg, list[i])
+		}
+	}
+}
+
+func TestSections(t *testing.T) {
+	gen, err := Assemble([]byte(`
+	SET A, value
+.section data
+:value	DAT 5
+.section text
+	SET PC, POP
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, gen, []uint16{0x8801, 0x61c1, 0x0005})
+
+	// labels at the end of a section stay in it
+	gen, err = Assemble([]byte(`
+:start	SET A, 1
+:end
+.section data
+	DAT end
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, gen, []uint16{0x8401, 0x0001})
+}
+
+func TestObjectErrors(t *testing.T) {
+	for _, c := range []struct{ src, msg string }{
+		{".org 5", "1:1: .org cannot be used in relocatable objects"},
+		{"SET A, label*2\n:label", "cannot be relocated"},
+		{"DAT one+two", "expression (one+two) cannot be relocated"},
+		{".global nothing", `1:9: exported symbol "nothing" is not defined`},
+		{".global val\n.equ val, ext", `1:9: symbol "val" cannot be exported`},
+		{":main\n\tSET PC, .loop", `2:10: undefined label "main.loop"`},
+		{"DAT 1\n.align 0x10000", "2:1: alignment of section text exceeds 0x8000"},
+	} {
+		_, err := (&Config{}).AssembleObject([]byte(c.src))
+		if err == nil || !strings.Contains(err.Error(), c.msg) {
+			t.Errorf("%q: expected error %q, got %v", c.src, c.msg, err)
+		}
+	}
+}
+
+func TestRelocatable(t *testing.T) {
+	prog, err := (&Config{}).AssembleRelocatable([]byte(`
+:start	SET PC, main
+:table	DAT start, end-start, 0x8000
+:main	SET A, [table+1]
+:end
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, prog.Image, []uint16{0x7dc1, 0x0005, 0x0000, 0x0007, 0x8000, 0x7801, 0x0003})
+	expect(t, prog.Relocs, []uint16{1, 2, 6})
+
+	_, err = (&Config{}).AssembleRelocatable([]byte(":start DAT start*2"))
+	if err == nil || !strings.Contains(err.Error(), "expression (start*2) cannot be relocated") {
+		t.Errorf("expected a relocation error, got %v", err)
+	}
+}
+
+func TestListing(t *testing.T) {
+	files := writeFiles(t, map[string]string{
+		"main.dasm": `.equ SCREEN, 0x8000
+.macro put ch
+	SET [SCREEN], ch
+.endm
+:start	put 0x41
+.include "sub.dasm"
+:data	DAT 1, 2, 3, 4, 5
+	.fill 6, 0
+`,
+		"sub.dasm": `:sub
+	SET PC, start
+`,
+	})
+	var buf bytes.Buffer
+	defer os.RemoveAll(files)
+	_, err := (&Config{Listing: &buf}).AssembleFile(filepath.Join(files, "main.dasm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	listing := strings.Replace(buf.String(), files+string(filepath.Separator), "", -1)
+	exp := `main.dasm:
+                                  1  .equ SCREEN, 0x8000
+                                  2  .macro put ch
+                                  3  	SET [SCREEN], ch
+                                  4  .endm
+0000  7de1 8000 0041              5  :start	put 0x41
+                                  6  .include "sub.dasm"
+sub.dasm:
+0003                              1  :sub
+0003  81c1                        2  	SET PC, start
+main.dasm:
+0004  0001 0002 0003 0004         7  :data	DAT 1, 2, 3, 4, 5
+0008  0005
+0009  0000 0000 0000 0000 ...     8  	.fill 6, 0
+
+symbol value kind defined at used at
+SCREEN 8000 const main.dasm:1:6 main.dasm:5:8
+data 0004 label main.dasm:7:1
+start 0000 label main.dasm:5:1 sub.dasm:2:10
+sub 0003 label sub.dasm:1:1
+`
+	// the width of the symbol table depends on the name of the directory
+	i := strings.Index(listing, "\nsymbol")
+	if i < 0 {
+		t.Fatalf("missing symbol table in\n%s", listing)
+	}
+	table := strings.Split(listing[i:], "\n")
+	for j, line := range table {
+		table[j] = strings.Join(strings.Fields(line), " ")
+	}
+	listing = listing[:i] + strings.Join(table, "\n")
+	if listing != exp {
+		t.Errorf("expected listing\n%s\ngot\n%s", exp, listing)
+	}
+}
+
+func TestSymbolMap(t *testing.T) {
+	var m symbols.Map
+	var consts map[string]uint16
+	_, err := (&Config{Symbols: &m, Constants: &consts}).Assemble([]byte(`
+.equ SIZE, 3
+:start	SET A, 1
+:.loop	ADD A, 1
+	SET PC, .loop
+:table	DAT 1, 2, SIZE
+:end
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := symbols.Map{
+		{Name: "start", Addr: 0, Kind: symbols.Code, Size: 3, Line: 3},
+		{Name: "start.loop", Addr: 1, Kind: symbols.Code, Size: 2, Line: 4},
+		{Name: "table", Addr: 3, Kind: symbols.Data, Size: 3, Line: 6},
+		{Name: "end", Addr: 6, Line: 7},
+	}
+	if !reflect.DeepEqual(m, exp) {
+		t.Errorf("expected %v, got %v", exp, m)
+	}
+	if !reflect.DeepEqual(consts, map[string]uint16{"SIZE": 3}) {
+		t.Errorf("expected the constant SIZE = 3, got %v", consts)
+	}
+}
+
+func TestSourceMap(t *testing.T) {
+	var m sourcemap.Map
+	_, err := (&Config{SourceMap: &m}).Assemble([]byte(`.macro twice reg
+	ADD reg, 1
+	ADD reg, 1
+.endm
+:start	SET A, 0x30
+	twice A
+	.reserve 2
+	DAT 1, 2
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := sourcemap.Map{
+		{Addr: 0, Size: 2, Line: 5},
+		{Addr: 2, Size: 2, Line: 6},
+		{Addr: 6, Size: 2, Line: 8, Data: true},
+	}
+	if !reflect.DeepEqual(m, exp) {
+		t.Errorf("expected %v, got %v", exp, m)
+	}
+}
@@ -0,0 +1,354 @@
+package assembler
+
+import (
+	"github.com/xconstruct/dcpu16/assembler/token"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Expr is a node of a constant expression. Expressions appear as
+// operands, inside indirect operands and as DAT values.
+type Expr interface {
+	String() string
+}
+
+// IntExpr is an integer constant.
+type IntExpr struct {
+	Val int
+}
+
+// LabelExpr references the address of a label.
+type LabelExpr struct {
+	Name string
+	Pos token.Position
+	macro *Expansion
+}
+
+// UnaryExpr is a unary operation (-x, +x or ~x).
+type UnaryExpr struct {
+	Op token.Token
+	X Expr
+}
+
+// BinaryExpr is a binary operation like x+y or x<<y.
+type BinaryExpr struct {
+	Op token.Token
+	X, Y Expr
+}
+
+// RegisterExpr is a register term inside an indirect operand,
+// as in [table+I].
+type RegisterExpr struct {
+	Name string
+}
+
+// pcExpr is the address of the statement it appears in, written as $.
+type pcExpr struct {
+	s *stmt
+}
+
+func (e *IntExpr) String() string { return strconv.Itoa(e.Val) }
+func (e *LabelExpr) String() string { return e.Name }
+func (e *RegisterExpr) String() string { return e.Name }
+func (e *pcExpr) String() string { return "$" }
+
+func (e *UnaryExpr) String() string {
+	return opString(e.Op) + e.X.String()
+}
+
+func (e *BinaryExpr) String() string {
+	return "(" + e.X.String() + opString(e.Op) + e.Y.String() + ")"
+}
+
+// opString returns the operator without the quotes of token.String.
+func opString(op token.Token) string {
+	s := op.String()
+	return s[1 : len(s)-1]
+}
+
+// isConst reports whether e can be evaluated without knowing any labels.
+func isConst(e Expr) bool {
+	switch e := e.(type) {
+	case *IntExpr:
+		return true
+	case *UnaryExpr:
+		return isConst(e.X)
+	case *BinaryExpr:
+		return isConst(e.X) && isConst(e.Y)
+	}
+	return false
+}
+
+// hasRegister reports whether a register appears anywhere in e.
+func hasRegister(e Expr) bool {
+	switch e := e.(type) {
+	case *RegisterExpr:
+		return true
+	case *UnaryExpr:
+		return hasRegister(e.X)
+	case *BinaryExpr:
+		return hasRegister(e.X) || hasRegister(e.Y)
+	}
+	return false
+}
+
+// undefinedLabel returns the first label in e that is not defined yet,
+// or nil if there is none.
+func (p *Parser) undefinedLabel(e Expr) *LabelExpr {
+	switch e := e.(type) {
+	case *LabelExpr:
+		if _, ok := p.defs[e.Name]; !ok {
+			return e
+		}
+	case *UnaryExpr:
+		return p.undefinedLabel(e.X)
+	case *BinaryExpr:
+		if l := p.undefinedLabel(e.X); l != nil {
+			return l
+		}
+		return p.undefinedLabel(e.Y)
+	}
+	return nil
+}
+
+// term is a summand of an expression, negated if neg is set.
+type term struct {
+	neg bool
+	x Expr
+}
+
+// terms flattens the top-level additions and subtractions of e.
+func terms(e Expr, neg bool, list []term) []term {
+	if b, ok := e.(*BinaryExpr); ok {
+		switch b.Op {
+		case token.ADD:
+			return terms(b.Y, neg, terms(b.X, neg, list))
+		case token.SUB:
+			return terms(b.Y, !neg, terms(b.X, neg, list))
+		}
+	}
+	return append(list, term{neg, e})
+}
+
+// splitRegister separates the register term from the address expression
+// of an indirect operand. reg is empty if there is no register and rest is
+// nil if the operand consists of the register alone.
+func splitRegister(e Expr) (reg string, rest Expr, err error) {
+	for _, t := range terms(e, false, nil) {
+		if r, ok := t.x.(*RegisterExpr); ok && !t.neg && reg == "" {
+			reg = r.Name
+			continue
+		}
+		if hasRegister(t.x) {
+			return "", nil, errors.New("assembler: a register can only be added once to an indirect address")
+		}
+		switch {
+		case rest == nil && t.neg:
+			rest = &UnaryExpr{token.SUB, t.x}
+		case rest == nil:
+			rest = t.x
+		case t.neg:
+			rest = &BinaryExpr{token.SUB, rest, t.x}
+		default:
+			rest = &BinaryExpr{token.ADD, rest, t.x}
+		}
+	}
+	return reg, rest, nil
+}
+
+// eval computes the value of e, looking up labels in p.labels
+// and symbols defined with .equ in p.consts.
+func (p *Parser) eval(e Expr) (int, error) {
+	switch e := e.(type) {
+	case *IntExpr:
+		return e.Val, nil
+	case *LabelExpr:
+		if addr, ok := p.labels[e.Name]; ok {
+			return int(addr), nil
+		}
+		if p.imports[e.Name] {
+			return 0, nil // resolved by the linker
+		}
+		c, ok := p.consts[e.Name]
+		if !ok && e.Name[0] == ':' {
+			return 0, &Error{Pos: e.Pos, Macro: e.macro,
+				Err: errors.New("assembler: no anonymous label for forward reference")}
+		}
+		if !ok {
+			return 0, &Error{Pos: e.Pos, Macro: e.macro,
+				Err: errors.New(fmt.Sprintf(`assembler: undefined label "%s"`, e.Name))}
+		}
+		if p.resolving[e.Name] {
+			return 0, errors.New(fmt.Sprintf(`assembler: symbol "%s" is defined in terms of itself`, e.Name))
+		}
+		p.resolving[e.Name] = true
+		defer delete(p.resolving, e.Name)
+		return p.eval(c)
+	case *pcExpr:
+		return e.s.addr, nil
+	case *UnaryExpr:
+		x, err := p.eval(e.X)
+		if err != nil {
+			return 0, err
+		}
+		switch e.Op {
+		case token.SUB:
+			return -x, nil
+		case token.TILDE:
+			return ^x, nil
+		}
+		return x, nil
+	case *BinaryExpr:
+		x, err := p.eval(e.X)
+		if err != nil {
+			return 0, err
+		}
+		y, err := p.eval(e.Y)
+		if err != nil {
+			return 0, err
+		}
+		return binaryOp(e.Op, x, y)
+	}
+	return 0, errors.New("assembler: registers are not allowed in expression " + e.String())
+}
+
+func binaryOp(op token.Token, x, y int) (int, error) {
+	switch op {
+	case token.ADD:
+		return x + y, nil
+	case token.SUB:
+		return x - y, nil
+	case token.MUL:
+		return x * y, nil
+	case token.AND:
+		return x & y, nil
+	case token.OR:
+		return x | y, nil
+	case token.XOR:
+		return x ^ y, nil
+	case token.EQL:
+		return boolInt(x == y), nil
+	case token.NEQ:
+		return boolInt(x != y), nil
+	case token.LSS:
+		return boolInt(x < y), nil
+	case token.GTR:
+		return boolInt(x > y), nil
+	case token.LEQ:
+		return boolInt(x <= y), nil
+	case token.GEQ:
+		return boolInt(x >= y), nil
+	case token.QUO, token.REM:
+		if y == 0 {
+			return 0, errors.New("assembler: division by zero in expression")
+		}
+		if op == token.QUO {
+			return x / y, nil
+		}
+		return x % y, nil
+	case token.SHL, token.SHR:
+		if y < 0 {
+			return 0, errors.New("assembler: negative shift count in expression")
+		}
+		if op == token.SHL {
+			return x << uint(y), nil
+		}
+		return x >> uint(y), nil
+	}
+	return 0, errors.New("assembler: unknown operator " + op.String())
+}
+
+// mustEval evaluates e and panics on errors.
+func (p *Parser) mustEval(e Expr) int {
+	n, err := p.eval(e)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// boolInt converts the result of a comparison into 1 or 0.
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// word truncates an expression value to 16 bits, warning if it does
+// not fit into a word as either a signed or an unsigned number.
+func (p *Parser) word(v int, e Expr) uint16 {
+	if (v < -0x8000 || v > 0xffff) && p.warnings != nil {
+		fmt.Fprintf(p.warnings, "%s: warning: %s = %#x overflows a word, truncated to %#04x\n",
+			p.cur.pos, e, v, uint16(v))
+	}
+	return uint16(v)
+}
+
+// parseExpr parses a constant expression.
+func (p *Parser) parseExpr() Expr {
+	return p.parseBinaryExpr(1)
+}
+
+func (p *Parser) parseBinaryExpr(prec1 int) Expr {
+	x := p.parseUnaryExpr()
+	for {
+		op := p.tok.Tok
+		prec := op.Precedence()
+		if prec < prec1 {
+			return x
+		}
+		p.nextImportant()
+		y := p.parseBinaryExpr(prec + 1)
+		x = &BinaryExpr{op, x, y}
+	}
+}
+
+func (p *Parser) parseUnaryExpr() Expr {
+	switch op := p.tok.Tok; op {
+	case token.ADD, token.SUB, token.TILDE:
+		p.nextImportant()
+		return &UnaryExpr{op, p.parseUnaryExpr()}
+	}
+	return p.parsePrimaryExpr()
+}
+
+func (p *Parser) parsePrimaryExpr() (x Expr) {
+	switch p.tok.Tok {
+	case token.INT:
+		n, err := strconv.ParseInt(p.tok.Lit, 0, 32)
+		if err != nil {
+			panic(errors.New(fmt.Sprintf("assembler: invalid number %s", p.tok.Lit)))
+		}
+		x = &IntExpr{int(n)}
+	case token.IDENT:
+		// Symbols defined earlier are substituted, so that constant
+		// symbols keep their expressions constant.
+		name := p.tok.Lit
+		if c, ok := p.consts[name]; ok {
+			x = c
+		} else {
+			name = p.qualify(name)
+			x = &LabelExpr{name, p.tok.Pos, p.tok.Macro}
+		}
+		p.refs[name] = append(p.refs[name], origin(p.tok.Pos, p.tok.Macro))
+	case token.ANON:
+		x = &LabelExpr{p.anonLabel(p.tok.Lit), p.tok.Pos, p.tok.Macro}
+	case token.DOLLAR:
+		x = &pcExpr{p.cur}
+	case token.REGISTER:
+		if !p.indirect {
+			p.unexpectedError()
+		}
+		x = &RegisterExpr{p.tok.Lit}
+	case token.LPAREN:
+		p.nextImportant()
+		x = p.parseExpr()
+		p.expect(token.RPAREN)
+	default:
+		p.unexpectedError()
+	}
+	p.nextImportant()
+	return
+}
@@ -0,0 +1,135 @@
+package assembler
+
+import (
+	"github.com/xconstruct/dcpu16/assembler/token"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// includer locates and reads the files of .include and .incbin.
+type includer struct {
+	paths []string
+	stack []string // files currently being included, to detect cycles
+	sources map[string][]byte
+	sites map[string][]token.Position // where each file was included, in order
+}
+
+// find returns the path of the file name included from pos. The file is
+// looked up relative to the including file first, then in the include paths.
+func (inc *includer) find(name string, pos token.Position) (string, error) {
+	if filepath.IsAbs(name) {
+		return name, nil
+	}
+	dirs := append([]string{filepath.Dir(pos.Filename)}, inc.paths...)
+	for _, dir := range dirs {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", errors.New(fmt.Sprintf(`assembler: cannot find file "%s"`, name))
+}
+
+// read finds and reads the file name included from pos.
+func (inc *includer) read(name string, pos token.Position) (path string, src []byte, err error) {
+	if path, err = inc.find(name, pos); err != nil {
+		return "", nil, err
+	}
+	src, err = ioutil.ReadFile(path)
+	if err == nil {
+		if inc.sources == nil {
+			inc.sources = make(map[string][]byte)
+		}
+		inc.sources[path] = src
+	}
+	return path, src, err
+}
+
+// line returns the source line at pos, if the file was read.
+func (inc *includer) line(pos token.Position) string {
+	lines := strings.Split(string(inc.sources[pos.Filename]), "\n")
+	if pos.Line < 1 || pos.Line > len(lines) {
+		return ""
+	}
+	return strings.TrimRight(lines[pos.Line-1], "\r")
+}
+
+// push marks path as being included. It fails if the file is already
+// being included, which would never terminate.
+func (inc *includer) push(path string) error {
+	for i, p := range inc.stack {
+		if sameFile(p, path) {
+			cycle := append(inc.stack[i:], path)
+			return errors.New("assembler: include cycle " + strings.Join(cycle, " -> "))
+		}
+	}
+	inc.stack = append(inc.stack, path)
+	return nil
+}
+
+func (inc *includer) pop() {
+	inc.stack = inc.stack[:len(inc.stack)-1]
+}
+
+func sameFile(a, b string) bool {
+	fa, errA := os.Stat(a)
+	fb, errB := os.Stat(b)
+	if errA != nil || errB != nil {
+		return filepath.Clean(a) == filepath.Clean(b)
+	}
+	return os.SameFile(fa, fb)
+}
+
+// include reads the file included by .include "file" at tokens[i], which
+// is being included until the parser has passed its tokens. It returns the
+// tokens of the file and the index of the file name.
+func (pp *preprocessor) include(tokens []TokenType, i int) ([]TokenType, int) {
+	dir := tokens[i]
+	i++
+	if tokens[i].Tok != token.STRING || !sameLine(tokens[i], dir) {
+		panic(&Error{Pos: tokens[i].Pos, Macro: tokens[i].Macro, Err: errors.New("assembler: expected file name after .include")})
+	}
+	fail := func(err error) {
+		panic(&Error{Pos: tokens[i].Pos, Macro: tokens[i].Macro, Err: err})
+	}
+	name, err := strconv.Unquote(tokens[i].Lit)
+	if err != nil {
+		fail(err)
+	}
+	path, src, err := pp.inc.read(name, tokens[i].Pos)
+	if err != nil {
+		fail(err)
+	}
+	if err := pp.inc.push(path); err != nil {
+		fail(err)
+	}
+	if pp.inc.sites == nil {
+		pp.inc.sites = make(map[string][]token.Position)
+	}
+	pp.inc.sites[path] = append(pp.inc.sites[path], origin(dir.Pos, dir.Macro))
+
+	included := scan(src, path)
+	return included[:len(included)-1], i // without EOF
+}
+
+// parseInclude parses .include "file" and continues with the tokens of
+// the file.
+func (p *Parser) parseInclude() {
+	tokens, last := p.pp.include(p.tokens, p.offset)
+	p.splice(last, tokens)
+	p.includes = append(p.includes, p.offset+len(tokens))
+	p.popIncludes()
+}
+
+// popIncludes ends the included files whose tokens have been passed.
+func (p *Parser) popIncludes() {
+	for len(p.includes) > 0 && p.offset >= p.includes[len(p.includes)-1] {
+		p.includes = p.includes[:len(p.includes)-1]
+		p.inc.pop()
+	}
+}
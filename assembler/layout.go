@@ -0,0 +1,284 @@
+package assembler
+
+import (
+	"github.com/xconstruct/dcpu16/assembler/token"
+	"github.com/xconstruct/dcpu16/object"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// operand is a parsed instruction operand. Operands with a next word keep
+// its expression, so that the word can be computed after layout.
+type operand struct {
+	code byte   // value code
+	shift uint  // bit offset in the instruction word
+	expr Expr   // value of the next word, or nil
+	relax bool  // label literal which may become a short literal
+	short bool  // relaxed into a short literal
+	pinned bool // grew back after relaxing and stays a next word
+}
+
+type stmtKind int
+
+const (
+	stmtInstr stmtKind = iota
+	stmtData
+	stmtOrg     // .org: moves the address to count
+	stmtAlign   // .align: pads with fill to a multiple of count
+	stmtFill    // .fill: count words of fill
+	stmtReserve // .reserve: count uninitialized words
+	stmtEnd     // end of a section, which holds the labels defined last
+	stmtEqu     // .equ: the address that $ in the value of the constant refers to
+)
+
+// section is a named part of the program. The statements of a section
+// are placed together, even if they are spread across the source.
+type section struct {
+	name string
+	align int // the address of the section is a multiple of align
+	addr int
+	size int
+	relocs []object.Reloc // relocations of an object
+}
+
+// stmt is a statement which occupies memory or moves the address.
+type stmt struct {
+	kind stmtKind
+	pos token.Position
+	macro *Expansion
+	addr int
+	section int     // index of the section in p.sections
+	op uint16       // opcode bits of an instruction
+	args []*operand // operands of an instruction
+	data []Expr     // words of a DAT statement
+	count int       // argument of a layout directive
+	fill Expr       // fill value of a layout directive, or nil for zero
+}
+
+// size returns the number of words the statement currently occupies.
+func (s *stmt) size() int {
+	switch s.kind {
+	case stmtData:
+		return len(s.data)
+	case stmtOrg, stmtEnd, stmtEqu:
+		return 0
+	case stmtAlign:
+		return (s.count - s.addr%s.count) % s.count
+	case stmtFill, stmtReserve:
+		return s.count
+	}
+	n := 1
+	for _, a := range s.args {
+		if a.expr != nil && !a.short {
+			n++
+		}
+	}
+	return n
+}
+
+// exprs returns all expressions of the statement.
+func (s *stmt) exprs() []Expr {
+	list := make([]Expr, 0, len(s.data)+len(s.args)+1)
+	list = append(list, s.data...)
+	for _, a := range s.args {
+		if a.expr != nil {
+			list = append(list, a.expr)
+		}
+	}
+	if s.fill != nil {
+		list = append(list, s.fill)
+	}
+	return list
+}
+
+// newStmt starts a new statement at the current position.
+func (p *Parser) newStmt() *stmt {
+	p.cur = &stmt{pos: p.tok.Pos, macro: p.tok.Macro, section: p.section}
+	p.stmts = append(p.stmts, p.cur)
+	return p.cur
+}
+
+// layout assigns addresses to all statements and labels. Unless disabled,
+// label literals whose value fits are relaxed into short literals and the
+// addresses are reflowed until nothing changes.
+func (p *Parser) layout() {
+	if p.object {
+		p.findImports()
+	}
+	for pass := 0; ; pass++ {
+		p.place()
+		for name, i := range p.defs {
+			p.labels[name] = uint16(p.stmts[i].addr)
+		}
+		if pass == 0 {
+			if p.check(); len(p.errors) > 0 {
+				return
+			}
+		}
+		if p.noRelax || !p.relax() {
+			p.checkOverlap()
+			return
+		}
+	}
+}
+
+// place assigns addresses to all statements. Sections follow each other
+// in the order they first appear, each aligned as it requires.
+func (p *Parser) place() {
+	addr := 0
+	for i, sec := range p.sections {
+		addr += (sec.align - addr%sec.align) % sec.align
+		sec.addr = addr
+		for _, s := range p.stmts {
+			if s.section != i {
+				continue
+			}
+			p.cur = s
+			if s.kind == stmtOrg {
+				addr = s.count
+			}
+			s.addr = addr
+			addr += s.size()
+			if addr > 0x10000 {
+				panic(errors.New(fmt.Sprintf("assembler: program exceeds the address space at %#04x", s.addr)))
+			}
+		}
+		sec.size = addr - sec.addr
+	}
+}
+
+// check evaluates every expression once all labels are known and
+// records all errors, such as references to undefined labels.
+func (p *Parser) check() {
+	for _, s := range p.stmts {
+		p.cur = s
+		for _, e := range s.exprs() {
+			if _, err := p.eval(e); err != nil {
+				p.errors.Add(withPos(err, s.pos, s.macro))
+			}
+		}
+	}
+	for _, g := range p.globals {
+		_, isLabel := p.defs[g.Lit]
+		_, isConst := p.consts[g.Lit]
+		if !isLabel && !isConst {
+			p.errors.Add(&Error{Pos: g.Pos, Macro: g.Macro,
+				Err: errors.New(fmt.Sprintf(`assembler: exported symbol "%s" is not defined`, g.Lit))})
+		}
+	}
+}
+
+// checkOverlap ensures that no two statements occupy the same memory,
+// which may happen when .org moves backwards.
+func (p *Parser) checkOverlap() {
+	used := make([]*stmt, 0, len(p.stmts))
+	for _, s := range p.stmts {
+		if s.size() > 0 {
+			used = append(used, s)
+		}
+	}
+	sort.Stable(byAddr(used))
+	for i := 1; i < len(used); i++ {
+		p.cur = used[i]
+		if prev := used[i-1]; prev.addr+prev.size() > used[i].addr {
+			panic(errors.New(fmt.Sprintf("assembler: code at %#04x overlaps code at %#04x-%#04x",
+				used[i].addr, prev.addr, prev.addr+prev.size()-1)))
+		}
+	}
+}
+
+type byAddr []*stmt
+
+func (s byAddr) Len() int           { return len(s) }
+func (s byAddr) Less(i, j int) bool { return s[i].addr < s[j].addr }
+func (s byAddr) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// relax shrinks label literals that fit into a short literal and grows
+// those that no longer fit. An operand that had to grow again is pinned
+// to the long form, which guarantees that layout terminates.
+// Returns whether any operand changed its size.
+func (p *Parser) relax() (changed bool) {
+	for _, s := range p.stmts {
+		p.cur = s
+		for _, a := range s.args {
+			if !a.relax || a.pinned {
+				continue
+			}
+			n := p.mustEval(a.expr)
+			fits := 0 <= n && n <= 0x1f
+			if fits != a.short {
+				a.short = fits
+				a.pinned = !fits
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// emit generates the memory image of all statements. Gaps between
+// statements and reserved space are filled with zeros.
+func (p *Parser) emit() {
+	end := 0
+	for _, s := range p.stmts {
+		if e := s.addr + s.size(); e > end {
+			end = e
+		}
+	}
+	p.gen = make([]uint16, end)
+
+	for _, s := range p.stmts {
+		p.cur = s
+		p.pos = s.addr
+		switch s.kind {
+		case stmtInstr:
+			p.emitInstr(s)
+		case stmtData:
+			for _, e := range s.data {
+				p.emitExpr(e)
+			}
+		case stmtAlign, stmtFill:
+			if s.fill == nil {
+				break
+			}
+			for i := s.size(); i > 0; i-- {
+				p.emitExpr(s.fill)
+			}
+		}
+	}
+}
+
+func (p *Parser) emitInstr(s *stmt) {
+	op := s.op
+	for _, a := range s.args {
+		code := a.code
+		if a.short {
+			code = 0x20 + byte(p.mustEval(a.expr))
+		}
+		op |= uint16(code) << a.shift
+	}
+	p.gen[p.pos] = op
+	p.pos++
+	for _, a := range s.args {
+		if a.expr != nil && !a.short {
+			p.emitExpr(a.expr)
+		}
+	}
+}
+
+// emitExpr writes the value of e as the next word. Words computed
+// from labels are recorded in fixlabels.
+func (p *Parser) emitExpr(e Expr) {
+	v := p.mustEval(e)
+	if !isConst(e) {
+		p.fixlabels = append(p.fixlabels, FixLabel{uint16(p.pos), e})
+		if p.object {
+			v = p.relocate(e)
+		} else if p.relocatable {
+			p.markAddress(e)
+		}
+	}
+	p.gen[p.pos] = p.word(v, e)
+	p.pos++
+}
@@ -0,0 +1,201 @@
+package assembler
+
+import (
+	"github.com/xconstruct/dcpu16/assembler/token"
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// wordsPerRow is the number of generated words shown in each row
+// of a listing.
+const wordsPerRow = 4
+
+// origin returns the position in the source files which generated a token.
+// For tokens of macros, this is the outermost invocation.
+func origin(pos token.Position, m *Expansion) token.Position {
+	for ; m != nil; m = m.Parent {
+		pos = m.Call
+	}
+	return pos
+}
+
+// lineKey identifies a line of a source file.
+type lineKey struct {
+	file string
+	line int
+}
+
+// writeListing writes every source line with the address and the words it
+// generated, followed by a table of all symbols and the lines that use them.
+// Lines of included files appear after the .include, and the words
+// generated by a macro appear at its invocation.
+func (p *Parser) writeListing(w io.Writer, inc *includer) error {
+	bw := bufio.NewWriter(w)
+	stmts := make(map[lineKey][]*stmt)
+	for _, s := range p.stmts {
+		pos := origin(s.pos, s.macro)
+		key := lineKey{pos.Filename, pos.Line}
+		stmts[key] = append(stmts[key], s)
+	}
+	labels := make(map[lineKey]uint16)
+	for name, pos := range p.symbols {
+		if _, ok := p.defs[name]; ok {
+			labels[lineKey{pos.Filename, pos.Line}] = p.labels[name]
+		}
+	}
+
+	// Follow the tokens through the files, so that included files are
+	// listed where they were included.
+	lines := make(map[string][]string)
+	done := make(map[string]int)
+	entered := make(map[string]int)
+	stack := make([]string, 0)
+	flush := func(file string, upto int) {
+		if lines[file] == nil {
+			lines[file] = strings.Split(strings.TrimSuffix(string(inc.sources[file]), "\n"), "\n")
+		}
+		for n := done[file] + 1; n <= upto && n <= len(lines[file]); n++ {
+			key := lineKey{file, n}
+			addr, isLabel := labels[key]
+			p.listLine(bw, n, lines[file][n-1], stmts[key], addr, isLabel)
+			done[file] = n
+		}
+	}
+	for _, tok := range p.tokens {
+		pos := origin(tok.Pos, tok.Macro)
+		if !pos.IsValid() {
+			continue
+		}
+		i := len(stack) - 1
+		for i >= 0 && stack[i] != pos.Filename {
+			i--
+		}
+		switch {
+		case i < 0: // entering an included file, after its .include
+			if sites := inc.sites[pos.Filename]; entered[pos.Filename] < len(sites) {
+				site := sites[entered[pos.Filename]]
+				flush(site.Filename, site.Line)
+			}
+			entered[pos.Filename]++
+			stack = append(stack, pos.Filename)
+			if pos.Filename != "" {
+				fmt.Fprintf(bw, "%s:\n", pos.Filename)
+			}
+		case i < len(stack)-1: // returning from included files
+			for _, file := range stack[i+1:] {
+				flush(file, len(lines[file]))
+			}
+			stack = stack[:i+1]
+			if pos.Filename != "" {
+				fmt.Fprintf(bw, "%s:\n", pos.Filename)
+			}
+		}
+		flush(pos.Filename, pos.Line)
+	}
+	for i := len(stack) - 1; i >= 0; i-- {
+		flush(stack[i], len(lines[stack[i]]))
+	}
+
+	p.listSymbols(bw)
+	return bw.Flush()
+}
+
+// listLine writes a source line together with the words of the statements
+// it generated. Reserved space and padding only show their first words.
+// A line which only defines a label shows the address of the label.
+func (p *Parser) listLine(w io.Writer, n int, src string, stmts []*stmt, label uint16, isLabel bool) {
+	type row struct {
+		addr int
+		words []uint16
+		more bool
+	}
+	rows := make([]row, 0)
+	for _, s := range stmts {
+		size := s.size()
+		if s.kind == stmtReserve || s.kind == stmtEnd || s.kind == stmtEqu || size == 0 {
+			if s.kind != stmtEnd && s.kind != stmtEqu {
+				rows = append(rows, row{s.addr, nil, false})
+			}
+			continue
+		}
+		for i := 0; i < size; i += wordsPerRow {
+			end := i + wordsPerRow
+			if end > size {
+				end = size
+			}
+			rows = append(rows, row{s.addr + i, p.gen[s.addr+i : s.addr+end], false})
+			if s.kind == stmtFill || s.kind == stmtAlign {
+				rows[len(rows)-1].more = end < size
+				break
+			}
+		}
+	}
+	if len(rows) == 0 && isLabel {
+		rows = append(rows, row{int(label), nil, false})
+	}
+
+	for i := 0; i == 0 || i < len(rows); i++ {
+		col := ""
+		if i < len(rows) {
+			col = fmt.Sprintf("%04x ", rows[i].addr)
+			for _, v := range rows[i].words {
+				col += fmt.Sprintf(" %04x", v)
+			}
+			if rows[i].more {
+				col += " ..."
+			}
+		}
+		if i == 0 {
+			fmt.Fprintf(w, "%-29s %5d  %s\n", col, n, src)
+		} else {
+			fmt.Fprintf(w, "%s\n", col)
+		}
+	}
+}
+
+// listSymbols writes all labels and constants, sorted by name, with
+// their value and the positions where they are defined and used.
+func (p *Parser) listSymbols(w io.Writer) {
+	names := make([]string, 0, len(p.symbols))
+	width := len("symbol")
+	for name := range p.symbols {
+		if name[0] == ':' { // anonymous labels
+			continue
+		}
+		names = append(names, name)
+		if len(name) > width {
+			width = len(name)
+		}
+	}
+	sort.Strings(names)
+
+	defs := make([]string, len(names))
+	defWidth := len("defined at")
+	for i, name := range names {
+		if defs[i] = p.symbols[name].String(); len(defs[i]) > defWidth {
+			defWidth = len(defs[i])
+		}
+	}
+
+	fmt.Fprintf(w, "\n%-*s  value  kind   %-*s  used at\n", width, "symbol", defWidth, "defined at")
+	for i, name := range names {
+		kind, value := "label", ""
+		if addr, ok := p.labels[name]; ok {
+			value = fmt.Sprintf("%04x", addr)
+		} else if n, err := p.eval(p.consts[name]); err == nil {
+			kind, value = "const", fmt.Sprintf("%04x", uint16(n))
+		} else {
+			kind, value = "const", "????"
+		}
+		refs := make([]string, len(p.refs[name]))
+		for i, pos := range p.refs[name] {
+			refs[i] = pos.String()
+		}
+		line := fmt.Sprintf("%-*s  %-5s  %-5s  %-*s  %s", width, name, value, kind,
+			defWidth, defs[i], strings.Join(refs, ", "))
+		fmt.Fprintln(w, strings.TrimRight(line, " "))
+	}
+}
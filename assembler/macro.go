@@ -0,0 +1,180 @@
+package assembler
+
+import (
+	"github.com/xconstruct/dcpu16/assembler/token"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// maxMacroDepth limits how deeply macro invocations may nest, which
+// stops infinitely recursive macros.
+const maxMacroDepth = 64
+
+// Expansion describes the invocation of a macro that generated a token.
+type Expansion struct {
+	Name string
+	Def token.Position  // position of the macro definition
+	Call token.Position // position of the invocation
+	Parent *Expansion   // enclosing expansion of nested invocations
+}
+
+type macro struct {
+	name string
+	pos token.Position
+	params []string
+	body []TokenType
+}
+
+// preprocessor includes files and defines and expands macros for the
+// parser, which splices the included and expanded tokens into its input.
+// This happens while parsing, so that directives in blocks of conditional
+// assembly which are not assembled are skipped.
+//
+// A macro is defined with
+//
+//	.macro name param1, param2, ...
+//	    body
+//	.endm
+//
+// and invoked by writing its name at the start of a statement, followed
+// by the comma-separated arguments on the same line. Identifiers in the
+// body which name a parameter are replaced by the tokens of the argument.
+// Labels defined in the body are local to each expansion.
+type preprocessor struct {
+	inc *includer
+	macros map[string]*macro
+	expansions int
+}
+
+// define records the macro defined at tokens[i] and returns the index
+// of its .endm.
+func (pp *preprocessor) define(tokens []TokenType, i int) int {
+	def := tokens[i]
+	fail := func(tok TokenType, msg string) {
+		panic(&Error{Pos: tok.Pos, Macro: tok.Macro, Err: errors.New("assembler: " + msg)})
+	}
+
+	i++
+	if tokens[i].Tok != token.IDENT || !sameLine(tokens[i], def) {
+		fail(tokens[i], "expected macro name after .macro")
+	}
+	m := &macro{name: tokens[i].Lit, pos: def.Pos}
+	if _, ok := pp.macros[m.name]; ok {
+		fail(tokens[i], fmt.Sprintf(`macro "%s" already defined!`, m.name))
+	}
+
+	for i++; sameLine(tokens[i], def) && tokens[i].Tok != token.COMMENT; i++ {
+		if len(m.params) > 0 {
+			if tokens[i].Tok != token.COMMA {
+				fail(tokens[i], "expected ',' between macro parameters")
+			}
+			i++
+		}
+		if tokens[i].Tok != token.IDENT || !sameLine(tokens[i], def) {
+			fail(tokens[i], fmt.Sprintf(`invalid macro parameter %s`, tokens[i].Tok))
+		}
+		m.params = append(m.params, tokens[i].Lit)
+	}
+
+	for ; tokens[i].Tok != token.DIR_ENDM; i++ {
+		switch tokens[i].Tok {
+		case token.EOF:
+			fail(def, fmt.Sprintf(`missing .endm for macro "%s"`, m.name))
+		case token.DIR_MACRO:
+			fail(tokens[i], "macros cannot be defined inside of macros")
+		case token.COMMENT:
+		default:
+			m.body = append(m.body, tokens[i])
+		}
+	}
+	pp.macros[m.name] = m
+	return i
+}
+
+// expand expands the invocation of m at tokens[i]. It returns the body
+// with the arguments substituted, whose invocations of macros are yet to
+// be expanded, and the index of the last token of the invocation.
+func (pp *preprocessor) expand(m *macro, tokens []TokenType, i int) ([]TokenType, int) {
+	call := tokens[i]
+	exp := &Expansion{m.name, m.pos, call.Pos, call.Macro}
+	depth := 0
+	for e := call.Macro; e != nil; e = e.Parent {
+		depth++
+	}
+	if depth >= maxMacroDepth {
+		panic(&Error{Pos: call.Pos, Macro: exp, Err: errors.New("assembler: macro invocations nested too deeply")})
+	}
+
+	// collect the arguments, split at commas outside of brackets
+	args := make([][]TokenType, 0)
+	var arg []TokenType
+	nesting := 0
+	for i+1 < len(tokens) && sameLine(tokens[i+1], call) && tokens[i+1].Tok != token.EOF {
+		i++
+		tok := tokens[i]
+		switch tok.Tok {
+		case token.COMMENT:
+			continue
+		case token.LBRACK, token.LPAREN:
+			nesting++
+		case token.RBRACK, token.RPAREN:
+			nesting--
+		case token.COMMA:
+			if nesting == 0 {
+				args = append(args, arg)
+				arg = nil
+				continue
+			}
+		}
+		arg = append(arg, tok)
+	}
+	if arg != nil || len(args) > 0 {
+		args = append(args, arg)
+	}
+	if len(args) != len(m.params) {
+		panic(&Error{Pos: call.Pos, Macro: exp, Err: errors.New(fmt.Sprintf(
+			"assembler: macro expects %d arguments, got %d", len(m.params), len(args)))})
+	}
+
+	params := make(map[string][]TokenType)
+	for n, name := range m.params {
+		params[name] = args[n]
+	}
+	locals := make(map[string]string)
+	pp.expansions++
+	for _, tok := range m.body {
+		if _, ok := params[tok.Lit]; tok.Tok == token.LABEL && tok.Lit != "" && !ok {
+			locals[tok.Lit] = tok.Lit + "@" + strconv.Itoa(pp.expansions)
+		}
+	}
+
+	body := make([]TokenType, 0, len(m.body))
+	for _, tok := range m.body {
+		tok.Macro = exp
+		switch tok.Tok {
+		case token.IDENT, token.LABEL:
+			if arg, ok := params[tok.Lit]; ok {
+				if tok.Tok == token.LABEL {
+					if len(arg) != 1 || arg[0].Tok != token.IDENT {
+						panic(&Error{Pos: tok.Pos, Macro: exp, Err: errors.New("assembler: label name expected as macro argument")})
+					}
+					tok.Lit = arg[0].Lit
+					break
+				}
+				// arguments take the line of the parameter, so that they
+				// stay part of the statement they are used in
+				for _, a := range arg {
+					a.Pos, a.Macro = tok.Pos, exp
+					body = append(body, a)
+				}
+				continue
+			}
+			if local, ok := locals[tok.Lit]; ok {
+				tok.Lit = local
+			}
+		}
+		body = append(body, tok)
+	}
+	return body, i
+}
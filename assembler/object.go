@@ -0,0 +1,195 @@
+package assembler
+
+import (
+	"github.com/xconstruct/dcpu16/assembler/token"
+	"github.com/xconstruct/dcpu16/object"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// reloc is a term of an expression that is only known when linking:
+// the address of a section or of an imported symbol.
+type reloc struct {
+	section int    // index of the section, or -1
+	symbol string  // imported symbol if section is -1
+}
+
+// findImports marks every symbol that is referenced but not defined as
+// imported, so that it is resolved by the linker. Local and anonymous
+// labels cannot be imported.
+func (p *Parser) findImports() {
+	p.imports = make(map[string]bool)
+	var walk func(e Expr)
+	walk = func(e Expr) {
+		switch e := e.(type) {
+		case *LabelExpr:
+			_, isLabel := p.defs[e.Name]
+			_, isConst := p.consts[e.Name]
+			if !isLabel && !isConst && !isLocal(e.Name) && !strings.ContainsAny(e.Name, ".:@") {
+				p.imports[e.Name] = true
+			}
+		case *UnaryExpr:
+			walk(e.X)
+		case *BinaryExpr:
+			walk(e.X)
+			walk(e.Y)
+		}
+	}
+	for _, s := range p.stmts {
+		for _, e := range s.exprs() {
+			walk(e)
+		}
+	}
+	for _, c := range p.consts {
+		walk(c)
+	}
+}
+
+// linear evaluates e as n plus the sum of the relocatable terms in t,
+// each multiplied by its factor. n is the value of e if all sections
+// were placed at address 0 and all imported symbols were 0.
+func (p *Parser) linear(e Expr) (n int, t map[reloc]int, err error) {
+	switch e := e.(type) {
+	case *LabelExpr:
+		if i, ok := p.defs[e.Name]; ok {
+			return p.relative(p.stmts[i])
+		}
+		if p.imports[e.Name] {
+			return 0, map[reloc]int{{section: -1, symbol: e.Name}: 1}, nil
+		}
+		if c, ok := p.consts[e.Name]; ok {
+			return p.linear(c)
+		}
+	case *pcExpr:
+		return p.relative(e.s)
+	case *UnaryExpr:
+		x, tx, err := p.linear(e.X)
+		if err != nil {
+			return 0, nil, err
+		}
+		switch {
+		case e.Op == token.SUB:
+			return -x, combine(nil, tx, -1), nil
+		case e.Op == token.TILDE && len(tx) == 0:
+			return ^x, nil, nil
+		case e.Op == token.ADD:
+			return x, tx, nil
+		}
+		return 0, nil, errors.New(fmt.Sprintf("assembler: expression %s cannot be relocated", e))
+	case *BinaryExpr:
+		x, tx, err := p.linear(e.X)
+		if err != nil {
+			return 0, nil, err
+		}
+		y, ty, err := p.linear(e.Y)
+		if err != nil {
+			return 0, nil, err
+		}
+		switch {
+		case e.Op == token.ADD:
+			return x + y, combine(tx, ty, 1), nil
+		case e.Op == token.SUB:
+			return x - y, combine(tx, ty, -1), nil
+		case e.Op == token.MUL && len(tx) == 0:
+			return x * y, combine(nil, ty, x), nil
+		case e.Op == token.MUL && len(ty) == 0:
+			return x * y, combine(nil, tx, y), nil
+		case len(tx) == 0 && len(ty) == 0:
+			n, err := binaryOp(e.Op, x, y)
+			return n, nil, err
+		}
+		return 0, nil, errors.New(fmt.Sprintf("assembler: expression %s cannot be relocated", e))
+	}
+	n, err = p.eval(e)
+	return n, nil, err
+}
+
+// relative returns the address of a statement relative to its section.
+func (p *Parser) relative(s *stmt) (int, map[reloc]int, error) {
+	return s.addr - p.sections[s.section].addr, map[reloc]int{{section: s.section}: 1}, nil
+}
+
+// combine returns the terms of x plus the terms of y multiplied by f.
+// Terms that cancel out are dropped.
+func combine(x, y map[reloc]int, f int) map[reloc]int {
+	t := make(map[reloc]int)
+	for r, n := range x {
+		t[r] = n
+	}
+	for r, n := range y {
+		if t[r] += n * f; t[r] == 0 {
+			delete(t, r)
+		}
+	}
+	return t
+}
+
+// relocate returns the value of the word at p.pos relative to the
+// address it depends on, and records the relocation of the word.
+func (p *Parser) relocate(e Expr) int {
+	n, t, err := p.linear(e)
+	if err != nil {
+		panic(err)
+	}
+	sec := p.sections[p.cur.section]
+	for r, f := range t {
+		if len(t) > 1 || f != 1 {
+			panic(errors.New(fmt.Sprintf("assembler: expression %s cannot be relocated", e)))
+		}
+		sec.relocs = append(sec.relocs, object.Reloc{Offset: uint16(p.pos - sec.addr), Section: r.section, Symbol: r.symbol})
+	}
+	return n
+}
+
+// markAddress lists the word at p.pos as a relocation if its value moves
+// with the program, which is the case if it is an address plus a constant.
+func (p *Parser) markAddress(e Expr) {
+	_, t, err := p.linear(e)
+	if err != nil {
+		panic(err)
+	}
+	n := 0
+	for _, f := range t {
+		n += f
+	}
+	switch n {
+	case 0: // a constant like the difference of two labels
+	case 1:
+		p.relocs = append(p.relocs, uint16(p.pos))
+	default:
+		panic(errors.New(fmt.Sprintf("assembler: expression %s cannot be relocated", e)))
+	}
+}
+
+// buildObject collects the sections and exported symbols into p.obj.
+func (p *Parser) buildObject() {
+	p.obj = &object.File{}
+	for _, sec := range p.sections {
+		data := make([]uint16, sec.size)
+		if sec.size > 0 {
+			copy(data, p.gen[sec.addr:])
+		}
+		p.obj.Sections = append(p.obj.Sections, &object.Section{Name: sec.name, Align: sec.align, Data: data, Relocs: sec.relocs})
+	}
+
+	exported := make(map[string]bool)
+	for _, g := range p.globals {
+		if exported[g.Lit] {
+			continue
+		}
+		exported[g.Lit] = true
+		n, t, err := p.linear(&LabelExpr{Name: g.Lit})
+		sym := object.Symbol{Name: g.Lit, Section: -1, Value: uint16(n)}
+		for r, f := range t {
+			if len(t) > 1 || f != 1 || r.section < 0 {
+				err = errors.New(fmt.Sprintf(`assembler: symbol "%s" cannot be exported`, g.Lit))
+			}
+			sym.Section = r.section
+		}
+		if err != nil {
+			panic(&Error{Pos: g.Pos, Macro: g.Macro, Err: err})
+		}
+		p.obj.Symbols = append(p.obj.Symbols, sym)
+	}
+}
@@ -9,18 +9,41 @@ type Scanner struct {
 	src []byte
 	ch rune
 	offset int
+	filename string
+	line int           // line of ch
+	lineOffset int     // offset of the first character of line
+	pos token.Position // position of the last scanned token
 }
 
 func (s *Scanner) Init(src []byte) {
+	s.InitFile("", src)
+}
+
+// InitFile prepares the scanner to tokenize src, which is the content of
+// the named file. The file name is only used for positions.
+func (s *Scanner) InitFile(filename string, src []byte) {
 	s.src = src
 	s.ch = ' '
 	s.offset = -1
+	s.filename = filename
+	s.line = 1
+	s.lineOffset = 0
+	s.pos = token.Position{Filename: filename, Line: 1, Column: 1}
 
 	s.next()
 }
 
+// Pos returns the position of the token returned by the last call to Scan.
+func (s *Scanner) Pos() token.Position {
+	return s.pos
+}
+
 func (s *Scanner) next() {
 	rdOffset := s.offset + 1
+	if s.ch == '\n' {
+		s.line++
+		s.lineOffset = rdOffset
+	}
 	if rdOffset < len(s.src) {
 		s.ch = rune(s.src[rdOffset])
 		s.offset = rdOffset
@@ -44,9 +67,20 @@ func (s *Scanner) skipWhitespace() {
 	}
 }
 
+// scanIdentifier scans a name like "loop" or "main.loop". Dots may only
+// appear inside of a name, so that local labels can be qualified.
 func (s *Scanner) scanIdentifier() string {
 	offs := s.offset
-	for isLetter(s.ch) || isDigit(s.ch) {
+	for isLetter(s.ch) || isDigit(s.ch) || s.ch == '.' && s.offset > offs {
+		s.next()
+	}
+	return string(s.src[offs:s.offset])
+}
+
+// scanRun scans a sequence of the character ch.
+func (s *Scanner) scanRun(ch rune) string {
+	offs := s.offset
+	for s.ch == ch {
 		s.next()
 	}
 	return string(s.src[offs:s.offset])
@@ -93,12 +127,33 @@ func (s *Scanner) scanNumber() (token.Token, string) {
 
 func (s *Scanner) scanComment() string {
 	offs := s.offset
-	for s.ch != '\n' {
+	for s.ch != '\n' && s.ch != -1 {
 		s.next()
 	}
 	return string(s.src[offs:s.offset])
 }
 
+// scanString scans a double-quoted string including its quotes.
+// Backslash escapes the following character. Returns false if the
+// string is not terminated on the same line.
+func (s *Scanner) scanString() (string, bool) {
+	offs := s.offset - 1 // opening quote
+	for s.ch != '"' {
+		if s.ch == '\n' || s.ch == -1 {
+			return string(s.src[offs:s.offset]), false
+		}
+		if s.ch == '\\' {
+			s.next()
+			if s.ch == '\n' || s.ch == -1 {
+				continue
+			}
+		}
+		s.next()
+	}
+	s.next()
+	return string(s.src[offs:s.offset]), true
+}
+
 func isRegister(ident string) bool {
 	if len(ident) != 1 {
 		return false
@@ -107,8 +162,33 @@ func isRegister(ident string) bool {
 	return (ch >= 'A' && ch <= 'C' || ch >= 'X' && ch <= 'Z' || ch == 'I' || ch == 'J')
 }
 
+// switch2 returns tok1 if the current character is '=' and tok0 otherwise,
+// for operators like "==" or "!=".
+func (s *Scanner) switch2(tok0, tok1 token.Token) token.Token {
+	if s.ch == '=' {
+		s.next()
+		return tok1
+	}
+	return tok0
+}
+
+// switch3 is like switch2, but returns tok2 if the current
+// character is ch2, for operators like "<<".
+func (s *Scanner) switch3(tok0, tok1 token.Token, ch2 rune, tok2 token.Token) token.Token {
+	if s.ch == ch2 {
+		s.next()
+		return tok2
+	}
+	return s.switch2(tok0, tok1)
+}
+
 func (s *Scanner) Scan() (tok token.Token, lit string) {
 	s.skipWhitespace()
+	s.pos = token.Position{
+		Filename: s.filename,
+		Line: s.line,
+		Column: s.offset - s.lineOffset + 1,
+	}
 
 	switch ch := s.ch; {
 	case isLetter(ch):
@@ -126,8 +206,27 @@ func (s *Scanner) Scan() (tok token.Token, lit string) {
 		s.next();
 		switch ch {
 		case ':':
-			lit = s.scanIdentifier()
+			// ":name" and ":.local" define labels and a lone ":" defines
+			// an anonymous label, which is referenced by ":-" or ":+"
 			tok = token.LABEL
+			switch {
+			case s.ch == '.':
+				s.next()
+				lit = "." + s.scanIdentifier()
+			case s.ch == '-' || s.ch == '+':
+				tok = token.ANON
+				lit = s.scanRun(s.ch)
+			default:
+				lit = s.scanIdentifier()
+			}
+		case '.':
+			if !isLetter(s.ch) {
+				tok = token.ILLEGAL
+				lit = string(ch)
+				break
+			}
+			lit = "." + s.scanIdentifier()
+			tok = token.Lookup(lit)
 		case '[':
 			tok = token.LBRACK
 		case ']':
@@ -135,14 +234,51 @@ func (s *Scanner) Scan() (tok token.Token, lit string) {
 		case ';':
 			tok = token.COMMENT
 			lit = s.scanComment()
+		case '"':
+			var ok bool
+			if lit, ok = s.scanString(); ok {
+				tok = token.STRING
+			} else {
+				tok = token.ILLEGAL
+			}
 		case ',':
 			tok = token.COMMA
+		case '(':
+			tok = token.LPAREN
+		case ')':
+			tok = token.RPAREN
+		case '$':
+			tok = token.DOLLAR
 		case '+':
 			tok = token.ADD
 		case '-':
 			tok = token.SUB
+		case '*':
+			tok = token.MUL
+		case '/':
+			tok = token.QUO
+		case '%':
+			tok = token.REM
+		case '&':
+			tok = token.AND
+		case '|':
+			tok = token.OR
+		case '^':
+			tok = token.XOR
+		case '~':
+			tok = token.TILDE
+		case '<':
+			tok = s.switch3(token.LSS, token.LEQ, '<', token.SHL)
+		case '>':
+			tok = s.switch3(token.GTR, token.GEQ, '>', token.SHR)
+		case '=':
+			tok = s.switch2(token.ILLEGAL, token.EQL)
+		case '!':
+			tok = s.switch2(token.ILLEGAL, token.NEQ)
 		default:
 			tok = token.ILLEGAL
+		}
+		if tok == token.ILLEGAL && lit == "" {
 			lit = string(ch)
 		}
 	}
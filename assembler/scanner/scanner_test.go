@@ -156,3 +156,102 @@ func TestNotch(t *testing.T) {
 	scanExpect(t, s, token.COMMENT, " 7dc1 000d [*]")
 	scanExpect(t, s, token.EOF, "")
 }
+
+func TestOperators(t *testing.T) {
+	s := &Scanner{}
+	s.Init([]byte(`(aa+b)-c*d/e%f<<g>>h&i|j^~$ < > <= >= == != = !`))
+
+	scanExpect(t, s, token.LPAREN, "")
+	scanExpect(t, s, token.IDENT, "aa")
+	scanExpect(t, s, token.ADD, "")
+	scanExpect(t, s, token.REGISTER, "b")
+	scanExpect(t, s, token.RPAREN, "")
+	scanExpect(t, s, token.SUB, "")
+	scanExpect(t, s, token.REGISTER, "c")
+	scanExpect(t, s, token.MUL, "")
+	scanExpect(t, s, token.IDENT, "d")
+	scanExpect(t, s, token.QUO, "")
+	scanExpect(t, s, token.IDENT, "e")
+	scanExpect(t, s, token.REM, "")
+	scanExpect(t, s, token.IDENT, "f")
+	scanExpect(t, s, token.SHL, "")
+	scanExpect(t, s, token.IDENT, "g")
+	scanExpect(t, s, token.SHR, "")
+	scanExpect(t, s, token.IDENT, "h")
+	scanExpect(t, s, token.AND, "")
+	scanExpect(t, s, token.REGISTER, "i")
+	scanExpect(t, s, token.OR, "")
+	scanExpect(t, s, token.REGISTER, "j")
+	scanExpect(t, s, token.XOR, "")
+	scanExpect(t, s, token.TILDE, "")
+	scanExpect(t, s, token.DOLLAR, "")
+	scanExpect(t, s, token.LSS, "")
+	scanExpect(t, s, token.GTR, "")
+	scanExpect(t, s, token.LEQ, "")
+	scanExpect(t, s, token.GEQ, "")
+	scanExpect(t, s, token.EQL, "")
+	scanExpect(t, s, token.NEQ, "")
+	scanExpect(t, s, token.ILLEGAL, "=")
+	scanExpect(t, s, token.ILLEGAL, "!")
+	scanExpect(t, s, token.EOF, "")
+}
+
+func TestDirective(t *testing.T) {
+	s := &Scanner{}
+	s.Init([]byte(`.org 0x8000 .ALIGN 4 .fill .reserve .unknown .`))
+
+	scanExpect(t, s, token.DIR_ORG, ".org")
+	scanExpect(t, s, token.INT, "0x8000")
+	scanExpect(t, s, token.DIR_ALIGN, ".ALIGN")
+	scanExpect(t, s, token.INT, "4")
+	scanExpect(t, s, token.DIR_FILL, ".fill")
+	scanExpect(t, s, token.DIR_RESERVE, ".reserve")
+	scanExpect(t, s, token.IDENT, ".unknown")
+	scanExpect(t, s, token.ILLEGAL, ".")
+	scanExpect(t, s, token.EOF, "")
+}
+
+func TestPos(t *testing.T) {
+	s := &Scanner{}
+	s.InitFile("test.dasm", []byte("SET A, B\n\n\t:label ; comment\nDAT 1 ; no newline"))
+
+	for _, exp := range []string{
+		"test.dasm:1:1", "test.dasm:1:5", "test.dasm:1:6", "test.dasm:1:8",
+		"test.dasm:3:2", "test.dasm:3:9", "test.dasm:4:1", "test.dasm:4:5",
+		"test.dasm:4:7", "test.dasm:4:19",
+	} {
+		s.Scan()
+		if got := s.Pos().String(); got != exp {
+			t.Fatalf("Expected position %s, but got %s\n", exp, got)
+		}
+	}
+	scanExpect(t, s, token.EOF, "")
+}
+
+func TestString(t *testing.T) {
+	s := &Scanner{}
+	s.Init([]byte(`.include "lib/math.dasm" "say \"hi\"" "open
+`))
+
+	scanExpect(t, s, token.DIR_INCLUDE, ".include")
+	scanExpect(t, s, token.STRING, `"lib/math.dasm"`)
+	scanExpect(t, s, token.STRING, `"say \"hi\""`)
+	scanExpect(t, s, token.ILLEGAL, `"open`)
+	scanExpect(t, s, token.EOF, "")
+}
+
+func TestLocalLabels(t *testing.T) {
+	s := &Scanner{}
+	s.Init([]byte(`:main :.loop :_skip : main.loop .loop :-- :+ :`))
+
+	scanExpect(t, s, token.LABEL, "main")
+	scanExpect(t, s, token.LABEL, ".loop")
+	scanExpect(t, s, token.LABEL, "_skip")
+	scanExpect(t, s, token.LABEL, "")
+	scanExpect(t, s, token.IDENT, "main.loop")
+	scanExpect(t, s, token.IDENT, ".loop")
+	scanExpect(t, s, token.ANON, "--")
+	scanExpect(t, s, token.ANON, "+")
+	scanExpect(t, s, token.LABEL, "")
+	scanExpect(t, s, token.EOF, "")
+}
@@ -0,0 +1,90 @@
+package assembler
+
+import (
+	"github.com/xconstruct/dcpu16/sourcemap"
+	"github.com/xconstruct/dcpu16/symbols"
+	"sort"
+	"strings"
+)
+
+// symbolMap returns the labels of the program as a symbol map. A label is
+// code if it is followed by an instruction and data otherwise. Its size
+// extends to the next label in the same section, where local labels and
+// the labels of macro expansions belong to the label before them. Labels
+// defined by a macro are positioned at its invocation.
+func (p *Parser) symbolMap() symbols.Map {
+	m := make(symbols.Map, 0, len(p.defs))
+	sections := make([]int, 0, len(p.defs))
+	for name, i := range p.defs {
+		if name[0] == ':' { // anonymous labels
+			continue
+		}
+		pos := p.symbols[name]
+		sym := symbols.Symbol{Name: name, Addr: p.labels[name], File: pos.Filename, Line: pos.Line}
+		for _, s := range p.stmts[i:] {
+			if s.section != p.stmts[i].section || s.size() == 0 {
+				continue
+			}
+			if s.kind == stmtInstr {
+				sym.Kind = symbols.Code
+			} else {
+				sym.Kind = symbols.Data
+			}
+			break
+		}
+		m = append(m, sym)
+	}
+	sort.Sort(m)
+	for _, sym := range m {
+		sections = append(sections, p.stmts[p.defs[sym.Name]].section)
+	}
+
+	for i := range m {
+		sec := p.sections[sections[i]]
+		end := sec.addr + sec.size
+		for j := i + 1; j < len(m); j++ {
+			local := strings.HasPrefix(m[j].Name, m[i].Name+".") || strings.Contains(m[j].Name, "@")
+			if sections[j] == sections[i] && m[j].Addr > m[i].Addr && !local {
+				end = int(m[j].Addr)
+				break
+			}
+		}
+		if end > int(m[i].Addr) {
+			m[i].Size = end - int(m[i].Addr)
+		}
+	}
+	return m
+}
+
+// constants returns the values of the named constants. Constants which
+// depend on symbols of other objects have no value yet and are left out.
+func (p *Parser) constants() map[string]uint16 {
+	m := make(map[string]uint16, len(p.consts))
+	for name, e := range p.consts {
+		if n, err := p.eval(e); err == nil {
+			m[name] = uint16(n)
+		}
+	}
+	return m
+}
+
+// sourceMap returns the source lines of the words of the program. The words
+// generated by a macro belong to the line which invoked it.
+func (p *Parser) sourceMap() sourcemap.Map {
+	m := make(sourcemap.Map, 0, len(p.stmts))
+	for _, s := range p.stmts {
+		size := s.size()
+		if s.kind == stmtReserve || size == 0 {
+			continue
+		}
+		pos, data := origin(s.pos, s.macro), s.kind != stmtInstr
+		if n := len(m); n > 0 && m[n-1].File == pos.Filename && m[n-1].Line == pos.Line &&
+			m[n-1].Data == data && int(m[n-1].Addr)+m[n-1].Size == s.addr {
+			m[n-1].Size += size
+			continue
+		}
+		m = append(m, sourcemap.Line{Addr: uint16(s.addr), Size: size, File: pos.Filename, Line: pos.Line, Data: data})
+	}
+	sort.Stable(m)
+	return m
+}
@@ -7,6 +7,34 @@ import (
 
 type Token int
 
+// Position describes a location in the source.
+type Position struct {
+	Filename string
+	Line int   // starting at 1
+	Column int // byte offset in the line, starting at 1
+}
+
+// IsValid reports whether the position is known.
+func (pos Position) IsValid() bool {
+	return pos.Line > 0
+}
+
+// String returns the position as "file:line:column", or "line:column"
+// if there is no file name.
+func (pos Position) String() string {
+	s := strconv.Itoa(pos.Line) + ":" + strconv.Itoa(pos.Column)
+	if pos.Filename != "" {
+		s = pos.Filename + ":" + s
+	}
+	if !pos.IsValid() {
+		s = pos.Filename
+		if s == "" {
+			s = "-"
+		}
+	}
+	return s
+}
+
 const (
 	// Special tokens
 	EMPTY Token = iota
@@ -17,8 +45,10 @@ const (
 
 	// Values
 	IDENT
+	ANON
 	REGISTER
 	INT
+	STRING
 	keyword_beg
 	SP
 	PC
@@ -49,14 +79,55 @@ const (
 
 	// extended
 	OP_DAT
+
+	// Directives
+	directive_beg
+	DIR_ORG
+	DIR_ALIGN
+	DIR_FILL
+	DIR_RESERVE
+	DIR_EQU
+	DIR_DEFINE
+	DIR_IF
+	DIR_IFDEF
+	DIR_IFNDEF
+	DIR_ELSE
+	DIR_ENDIF
+	DIR_MACRO
+	DIR_ENDM
+	DIR_INCLUDE
+	DIR_INCBIN
+	DIR_SECTION
+	DIR_GLOBAL
+	directive_end
 	keyword_end
 
 	// Delimiters and misc
 	COMMA
 	LBRACK
 	RBRACK
+	LPAREN
+	RPAREN
+	DOLLAR
+
+	// Operators
 	ADD
 	SUB
+	MUL
+	QUO
+	REM
+	SHL
+	SHR
+	AND
+	OR
+	XOR
+	TILDE
+	EQL
+	NEQ
+	LSS
+	GTR
+	LEQ
+	GEQ
 )
 
 var tokens = [...]string{
@@ -68,8 +139,10 @@ var tokens = [...]string{
 
 	// Values,
 	IDENT: "IDENT",
+	ANON: "ANON",
 	REGISTER: "REGISTER",
 	INT: "INT",
+	STRING: "STRING",
 	SP: "SP",
 	PC: "PC",
 	PUSH: "PUSH",
@@ -100,12 +173,51 @@ var tokens = [...]string{
 	// extended
 	OP_DAT: "DAT",
 
+	// Directives
+	DIR_ORG: ".org",
+	DIR_ALIGN: ".align",
+	DIR_FILL: ".fill",
+	DIR_RESERVE: ".reserve",
+	DIR_EQU: ".equ",
+	DIR_DEFINE: ".define",
+	DIR_IF: ".if",
+	DIR_IFDEF: ".ifdef",
+	DIR_IFNDEF: ".ifndef",
+	DIR_ELSE: ".else",
+	DIR_ENDIF: ".endif",
+	DIR_MACRO: ".macro",
+	DIR_ENDM: ".endm",
+	DIR_INCLUDE: ".include",
+	DIR_INCBIN: ".incbin",
+	DIR_SECTION: ".section",
+	DIR_GLOBAL: ".global",
+
 	// Delimiters and misc,
 	COMMA: "','",
 	LBRACK: "'['",
 	RBRACK: "']'",
+	LPAREN: "'('",
+	RPAREN: "')'",
+	DOLLAR: "'$'",
+
+	// Operators
 	ADD: "'+'",
 	SUB: "'-'",
+	MUL: "'*'",
+	QUO: "'/'",
+	REM: "'%'",
+	SHL: "'<<'",
+	SHR: "'>>'",
+	AND: "'&'",
+	OR: "'|'",
+	XOR: "'^'",
+	TILDE: "'~'",
+	EQL: "'=='",
+	NEQ: "'!='",
+	LSS: "'<'",
+	GTR: "'>'",
+	LEQ: "'<='",
+	GEQ: "'>='",
 }
 
 func (tok Token) String() string {
@@ -131,12 +243,42 @@ func (tok Token) IsOp() bool {
 	return tok.IsBasicOp() || tok.IsComplexOp()
 }
 
+func (tok Token) IsDirective() bool {
+	return tok > directive_beg && tok < directive_end
+}
+
+// Precedence returns the precedence of a binary operator in constant
+// expressions, or 0 if tok is not a binary operator. The levels follow C.
+func (tok Token) Precedence() int {
+	switch tok {
+	case OR:
+		return 1
+	case XOR:
+		return 2
+	case AND:
+		return 3
+	case EQL, NEQ:
+		return 4
+	case LSS, GTR, LEQ, GEQ:
+		return 5
+	case SHL, SHR:
+		return 6
+	case ADD, SUB:
+		return 7
+	case MUL, QUO, REM:
+		return 8
+	}
+	return 0
+}
+
 var keywords map[string]Token
 
 func init() {
 	keywords = make(map[string]Token)
 	for i := keyword_beg + 1; i < keyword_end; i++ {
-		keywords[tokens[i]] = i
+		if tokens[i] != "" {
+			keywords[tokens[i]] = i
+		}
 	}
 }
 
@@ -0,0 +1,215 @@
+// Package coverage records which instructions and branches of a DCPU program
+// are executed, and reports them by the lines of its source.
+//
+// A Coverage is an emulator.Tracer. The branches of a program are its IFE,
+// IFN, IFG and IFB instructions, each of which either runs the following
+// instruction, when its test succeeds, or skips it.
+package coverage
+
+import (
+	"github.com/xconstruct/dcpu16/emulator"
+	"github.com/xconstruct/dcpu16/sourcemap"
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Coverage records the execution of a program.
+type Coverage struct {
+	Execs   []uint64 // executions of the instruction at each address
+	Taken   []uint64 // tests at each address that ran the next instruction
+	Skipped []uint64 // tests at each address that skipped the next instruction
+}
+
+// New returns an empty coverage.
+func New() *Coverage {
+	return &Coverage{
+		Execs:   make([]uint64, 0x10000),
+		Taken:   make([]uint64, 0x10000),
+		Skipped: make([]uint64, 0x10000),
+	}
+}
+
+// Trace records an executed instruction.
+func (c *Coverage) Trace(s *emulator.TraceStep) {
+	c.Execs[s.PC]++
+	if !isTest(s.Words[0]) {
+		return
+	}
+	for _, r := range s.Regs {
+		if r.Reg == emulator.RegPC {
+			c.Skipped[s.PC]++
+			return
+		}
+	}
+	c.Taken[s.PC]++
+}
+
+// isTest reports whether word starts an IFx instruction.
+func isTest(word uint16) bool {
+	level, op, _ := emulator.GetOp(word)
+	return level == 0 && op >= 0xc
+}
+
+// Line is the coverage of a source line.
+type Line struct {
+	Line     int
+	Instrs   int      // number of instructions
+	Covered  int      // number of executed instructions
+	Hits     uint64   // executions of its most executed instruction
+	Branches []Branch // tests in the order of their addresses
+}
+
+// Branch is the coverage of a test.
+type Branch struct {
+	Addr    uint16
+	Taken   uint64
+	Skipped uint64
+}
+
+// File is the coverage of a source file.
+type File struct {
+	Name  string
+	Lines []*Line // lines with instructions, sorted
+}
+
+// Report returns the coverage of the instructions of mem by source file,
+// sorted by name. Lines which are data in the source map are left out.
+func (c *Coverage) Report(mem []uint16, lines sourcemap.Map) []*File {
+	files := make(map[string]*File)
+	byLine := make(map[string]map[int]*Line)
+	for _, l := range lines {
+		if l.Data {
+			continue
+		}
+		f := files[l.File]
+		if f == nil {
+			f = &File{Name: l.File}
+			files[l.File] = f
+			byLine[l.File] = make(map[int]*Line)
+		}
+		line := byLine[l.File][l.Line]
+		if line == nil {
+			line = &Line{Line: l.Line}
+			byLine[l.File][l.Line] = line
+			f.Lines = append(f.Lines, line)
+		}
+
+		// walk the instructions of the range
+		for addr := int(l.Addr); addr < int(l.Addr)+l.Size && addr < len(mem); {
+			word := mem[addr]
+			line.Instrs++
+			if n := c.Execs[addr]; n > 0 {
+				line.Covered++
+				if n > line.Hits {
+					line.Hits = n
+				}
+			}
+			if isTest(word) {
+				line.Branches = append(line.Branches, Branch{uint16(addr), c.Taken[addr], c.Skipped[addr]})
+			}
+			addr += emulator.InstructionSize(word)
+		}
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	report := make([]*File, len(names))
+	for i, name := range names {
+		report[i] = files[name]
+		sort.Sort(byNumber(report[i].Lines))
+	}
+	return report
+}
+
+type byNumber []*Line
+
+func (l byNumber) Len() int           { return len(l) }
+func (l byNumber) Less(i, j int) bool { return l[i].Line < l[j].Line }
+func (l byNumber) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// Counts returns the number of lines and branches of a file, and how many
+// of them were covered. Each test counts as two branches, which are
+// covered if the test ran and if it skipped the next instruction.
+func (f *File) Counts() (lines, linesHit, branches, branchesHit int) {
+	for _, l := range f.Lines {
+		lines++
+		if l.Hits > 0 {
+			linesHit++
+		}
+		for _, b := range l.Branches {
+			branches += 2
+			if b.Taken > 0 {
+				branchesHit++
+			}
+			if b.Skipped > 0 {
+				branchesHit++
+			}
+		}
+	}
+	return
+}
+
+// WriteSummary writes the covered lines and branches of each file and
+// of all files together.
+func WriteSummary(w io.Writer, files []*File) error {
+	bw := bufio.NewWriter(w)
+	width := len("total")
+	for _, f := range files {
+		if len(f.Name) > width {
+			width = len(f.Name)
+		}
+	}
+	var total [4]int
+	for _, f := range files {
+		lines, linesHit, branches, branchesHit := f.Counts()
+		writeCounts(bw, width, f.Name, lines, linesHit, branches, branchesHit)
+		total[0] += lines
+		total[1] += linesHit
+		total[2] += branches
+		total[3] += branchesHit
+	}
+	writeCounts(bw, width, "total", total[0], total[1], total[2], total[3])
+	return bw.Flush()
+}
+
+func writeCounts(w io.Writer, width int, name string, lines, linesHit, branches, branchesHit int) {
+	fmt.Fprintf(w, "%-*s  lines %5d/%-5d %6s  branches %5d/%-5d %6s\n", width, name,
+		linesHit, lines, percent(linesHit, lines), branchesHit, branches, percent(branchesHit, branches))
+}
+
+func percent(n, total int) string {
+	if total == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", 100*float64(n)/float64(total))
+}
+
+// WriteLcov writes the coverage in the lcov tracefile format, which
+// genhtml and most coverage services read. The two branches of each test
+// are numbered 0 for running and 1 for skipping the next instruction.
+func WriteLcov(w io.Writer, files []*File) error {
+	bw := bufio.NewWriter(w)
+	for _, f := range files {
+		fmt.Fprintf(bw, "TN:\nSF:%s\n", f.Name)
+		for _, l := range f.Lines {
+			for i, b := range l.Branches {
+				taken, skipped := "-", "-"
+				if b.Taken+b.Skipped > 0 {
+					taken, skipped = fmt.Sprint(b.Taken), fmt.Sprint(b.Skipped)
+				}
+				fmt.Fprintf(bw, "BRDA:%d,%d,0,%s\nBRDA:%d,%d,1,%s\n", l.Line, i, taken, l.Line, i, skipped)
+			}
+		}
+		for _, l := range f.Lines {
+			fmt.Fprintf(bw, "DA:%d,%d\n", l.Line, l.Hits)
+		}
+		lines, linesHit, branches, branchesHit := f.Counts()
+		fmt.Fprintf(bw, "BRF:%d\nBRH:%d\nLF:%d\nLH:%d\nend_of_record\n", branches, branchesHit, lines, linesHit)
+	}
+	return bw.Flush()
+}
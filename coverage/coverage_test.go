@@ -0,0 +1,95 @@
+package coverage
+
+import (
+	"github.com/xconstruct/dcpu16/assembler"
+	"github.com/xconstruct/dcpu16/emulator"
+	"github.com/xconstruct/dcpu16/sourcemap"
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+const src = `
+:start	SET I, 0
+:.loop	ADD I, 1
+	IFE I, 0xffff
+		SET PC, never
+	IFG 3, I
+		SET PC, .loop
+:halt	SET PC, halt
+:never	SET A, 1
+	SET PC, halt
+:table	DAT 1, 2, 3
+`
+
+func run(t *testing.T) []*File {
+	var lines sourcemap.Map
+	gen, err := (&assembler.Config{SourceMap: &lines}).Assemble([]byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dcpu := emulator.NewDCPU()
+	dcpu.Load(gen)
+	mem := make([]uint16, len(dcpu.RAM))
+	copy(mem, dcpu.RAM)
+	c := New()
+	dcpu.Tracer = c
+	if halted, err := dcpu.Run(nil); !halted || err != nil {
+		t.Fatalf("expected the program to halt, got %v, %v", halted, err)
+	}
+	return c.Report(mem, lines)
+}
+
+func TestReport(t *testing.T) {
+	files := run(t)
+	if len(files) != 1 {
+		t.Fatalf("expected 1 file, got %d", len(files))
+	}
+	exp := []*Line{
+		{Line: 2, Instrs: 1, Covered: 1, Hits: 1},
+		{Line: 3, Instrs: 1, Covered: 1, Hits: 3},
+		{Line: 4, Instrs: 1, Covered: 1, Hits: 3, Branches: []Branch{{0x0002, 0, 3}}},
+		{Line: 5, Instrs: 1, Covered: 0, Hits: 0},
+		{Line: 6, Instrs: 1, Covered: 1, Hits: 3, Branches: []Branch{{0x0005, 2, 1}}},
+		{Line: 7, Instrs: 1, Covered: 1, Hits: 2},
+		{Line: 8, Instrs: 1, Covered: 1, Hits: 1},
+		{Line: 9, Instrs: 1, Covered: 0, Hits: 0},
+		{Line: 10, Instrs: 1, Covered: 0, Hits: 0},
+	}
+	if !reflect.DeepEqual(files[0].Lines, exp) {
+		for _, l := range files[0].Lines {
+			t.Logf("%+v", *l)
+		}
+		t.Fatalf("unexpected lines")
+	}
+	lines, linesHit, branches, branchesHit := files[0].Counts()
+	if lines != 9 || linesHit != 6 || branches != 4 || branchesHit != 3 {
+		t.Errorf("expected 6/9 lines and 3/4 branches, got %d/%d and %d/%d",
+			linesHit, lines, branchesHit, branches)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	files := run(t)
+	var buf bytes.Buffer
+	if err := WriteSummary(&buf, files); err != nil {
+		t.Fatal(err)
+	}
+	exp := "       lines     6/9      66.7%  branches     3/4      75.0%\n" +
+		"total  lines     6/9      66.7%  branches     3/4      75.0%\n"
+	if buf.String() != exp {
+		t.Errorf("expected summary\n%s\ngot\n%s", exp, buf.String())
+	}
+
+	buf.Reset()
+	if err := WriteLcov(&buf, files); err != nil {
+		t.Fatal(err)
+	}
+	exp = "TN:\nSF:\n" +
+		"BRDA:4,0,0,0\nBRDA:4,0,1,3\nBRDA:6,0,0,2\nBRDA:6,0,1,1\n" +
+		"DA:2,1\nDA:3,3\nDA:4,3\nDA:5,0\nDA:6,3\nDA:7,2\nDA:8,1\nDA:9,0\nDA:10,0\n" +
+		"BRF:4\nBRH:3\nLF:9\nLH:6\nend_of_record\n"
+	if buf.String() != exp {
+		t.Errorf("expected lcov\n%s\ngot\n%s", exp, buf.String())
+	}
+}
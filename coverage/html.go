@@ -0,0 +1,105 @@
+package coverage
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+var htmlTemplate = template.Must(template.New("coverage").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Coverage</title>
+<style>
+body { font-family: sans-serif; }
+table.source { border-collapse: collapse; font-family: monospace; white-space: pre; }
+table.source td { padding: 0 0.5em; }
+td.num { text-align: right; color: #888; }
+tr.covered td.src { background: #cfc; }
+tr.uncovered td.src { background: #fcc; }
+tr.partial td.src { background: #ffc; }
+</style>
+</head>
+<body>
+<h1>Coverage</h1>
+<pre>{{.Summary}}</pre>
+{{range .Files}}
+<h2 id="{{.Name}}">{{.Name}}</h2>
+<table class="source">
+{{range .Lines}}<tr class="{{.Class}}"><td class="num">{{.Number}}</td><td class="num">{{.Hits}}</td><td class="num">{{.Branches}}</td><td class="src">{{.Source}}</td></tr>
+{{end}}</table>
+{{end}}
+</body>
+</html>
+`))
+
+type htmlLine struct {
+	Number   int
+	Hits     string
+	Branches string // covered and total branches
+	Class    string // covered, uncovered, partial or empty for lines without instructions
+	Source   string
+}
+
+type htmlFile struct {
+	Name  string
+	Lines []htmlLine
+}
+
+// WriteHTML writes the coverage as an HTML page, which shows the source of
+// each file with the executions of each line and its covered branches.
+// Lines are partially covered if some of their instructions or branches
+// did not run. The source files are read from their names.
+func WriteHTML(w io.Writer, files []*File) error {
+	var summary bytes.Buffer
+	WriteSummary(&summary, files)
+	data := struct {
+		Summary string
+		Files   []htmlFile
+	}{summary.String(), nil}
+
+	for _, f := range files {
+		src, err := ioutil.ReadFile(f.Name)
+		if err != nil {
+			return err
+		}
+		lines := make(map[int]*Line)
+		for _, l := range f.Lines {
+			lines[l.Line] = l
+		}
+		hf := htmlFile{Name: f.Name}
+		for i, text := range strings.Split(strings.TrimSuffix(string(src), "\n"), "\n") {
+			hl := htmlLine{Number: i + 1, Source: text}
+			if l := lines[i+1]; l != nil {
+				hl.Hits = fmt.Sprint(l.Hits)
+				hit := 0
+				for _, b := range l.Branches {
+					if b.Taken > 0 {
+						hit++
+					}
+					if b.Skipped > 0 {
+						hit++
+					}
+				}
+				if len(l.Branches) > 0 {
+					hl.Branches = fmt.Sprintf("%d/%d", hit, 2*len(l.Branches))
+				}
+				switch {
+				case l.Covered == 0:
+					hl.Class = "uncovered"
+				case l.Covered < l.Instrs || hit < 2*len(l.Branches):
+					hl.Class = "partial"
+				default:
+					hl.Class = "covered"
+				}
+			}
+			hf.Lines = append(hf.Lines, hl)
+		}
+		data.Files = append(data.Files, hf)
+	}
+	return htmlTemplate.Execute(w, data)
+}
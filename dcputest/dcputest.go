@@ -0,0 +1,158 @@
+// Package dcputest runs DCPU programs in Go tests.
+//
+// Run assembles a program, runs it until it halts and returns it for
+// assertions, which report their failures to the test:
+//
+//	func TestShift(t *testing.T) {
+//		dcputest.Run(t, `
+//			SET X, 4
+//			SHL X, 4
+//			SET [result], X
+//		:halt	SET PC, halt
+//		:result	DAT 0
+//		`).ExpectReg("X", 0x40).ExpectLabel("result", 0x40)
+//	}
+//
+// A program halts at an instruction which changes neither PC nor SP, like
+// SET PC, halt. The DCPU has no hardware in this version of the
+// specification, so a program has no output besides its registers and
+// memory.
+package dcputest
+
+import (
+	"github.com/xconstruct/dcpu16/assembler"
+	"github.com/xconstruct/dcpu16/emulator"
+	"github.com/xconstruct/dcpu16/symbols"
+	"github.com/xconstruct/dcpu16/trace"
+	"github.com/xconstruct/dcpu16/words"
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// DefaultCycles is the cycle limit of Run.
+const DefaultCycles = 1000000
+
+// Config configures the running of programs.
+type Config struct {
+	Cycles uint64 // fail programs that do not halt within this many cycles, or 0 for no limit
+}
+
+// Program is a program that was run to its halt.
+type Program struct {
+	DCPU    *emulator.DCPU
+	Symbols symbols.Map
+
+	t testing.TB
+}
+
+// Run assembles src, runs it until it halts within DefaultCycles and
+// returns the halted program. A program that does not assemble or halt
+// fails the test at once.
+func Run(t testing.TB, src string) *Program {
+	t.Helper()
+	return (&Config{Cycles: DefaultCycles}).Run(t, src)
+}
+
+// Run assembles src, runs it until it halts and returns the halted program.
+func (c *Config) Run(t testing.TB, src string) *Program {
+	t.Helper()
+	p := &Program{DCPU: emulator.NewDCPU(), t: t}
+	gen, err := (&assembler.Config{Symbols: &p.Symbols}).Assemble([]byte(src))
+	if err != nil {
+		t.Fatalf("dcputest: %v", err)
+	}
+	p.DCPU.Load(gen)
+	halted, err := p.DCPU.RunCycles(nil, c.Cycles)
+	switch {
+	case err != nil:
+		t.Fatalf("dcputest: %v at %s\n%s", err, p.where(), p.registers())
+	case !halted:
+		t.Fatalf("dcputest: the program did not halt within %d cycles, at %s\n%s", c.Cycles, p.where(), p.registers())
+	}
+	return p
+}
+
+// where returns PC with its label.
+func (p *Program) where() string {
+	s := fmt.Sprintf("0x%04x", p.DCPU.PC)
+	if name := p.Symbols.Name(p.DCPU.PC); name != "" {
+		s += " (" + name + ")"
+	}
+	return s
+}
+
+// registers returns a line with the values of all registers.
+func (p *Program) registers() string {
+	regs := make([]string, len(trace.RegisterNames))
+	for i, name := range trace.RegisterNames {
+		regs[i] = fmt.Sprintf("%s=0x%04x", name, p.DCPU.Register(i))
+	}
+	return "registers: " + strings.Join(regs, " ")
+}
+
+// Reg returns the value of the named register, like "A", "SP" or "PC".
+func (p *Program) Reg(name string) uint16 {
+	p.t.Helper()
+	n := trace.Register(strings.ToUpper(name))
+	if n < 0 {
+		p.t.Fatalf("dcputest: unknown register %q", name)
+	}
+	return p.DCPU.Register(n)
+}
+
+// Addr returns the address of a label.
+func (p *Program) Addr(label string) uint16 {
+	p.t.Helper()
+	for _, sym := range p.Symbols {
+		if sym.Name == label {
+			return sym.Addr
+		}
+	}
+	p.t.Fatalf("dcputest: unknown label %q", label)
+	return 0
+}
+
+// ExpectReg checks the value of the named register.
+func (p *Program) ExpectReg(name string, value uint16) *Program {
+	p.t.Helper()
+	if got := p.Reg(name); got != value {
+		p.t.Errorf("register %s = 0x%04x, want 0x%04x\n%s", strings.ToUpper(name), got, value, p.registers())
+	}
+	return p
+}
+
+// ExpectMem checks the words starting at addr. A mismatch is reported with
+// a dump of the lines that differ, the words of the program prefixed by
+// "-" and the expected words by "+".
+func (p *Program) ExpectMem(addr uint16, values ...uint16) *Program {
+	p.t.Helper()
+	if msg := p.diff(addr, values); msg != "" {
+		p.t.Errorf("memory at 0x%04x differs:\n%s", addr, msg)
+	}
+	return p
+}
+
+// ExpectLabel checks the words starting at the address of a label.
+func (p *Program) ExpectLabel(label string, values ...uint16) *Program {
+	p.t.Helper()
+	addr := p.Addr(label)
+	if msg := p.diff(addr, values); msg != "" {
+		p.t.Errorf("memory at %s (0x%04x) differs:\n%s", label, addr, msg)
+	}
+	return p
+}
+
+// diff returns a dump of the differences between the memory at addr and
+// values, or an empty string if they are equal.
+func (p *Program) diff(addr uint16, values []uint16) string {
+	want := make([]uint16, len(p.DCPU.RAM))
+	copy(want, p.DCPU.RAM)
+	for i, v := range values {
+		want[int(addr+uint16(i))] = v
+	}
+	var buf bytes.Buffer
+	words.DumpDiff(&buf, p.DCPU.RAM, want, words.DumpOptions{Start: int(addr), Length: len(values)})
+	return buf.String()
+}
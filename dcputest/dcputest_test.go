@@ -0,0 +1,81 @@
+package dcputest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// recorder records the failures of a test.
+type recorder struct {
+	testing.TB
+	failures []string
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.failures = append(r.failures, fmt.Sprintf(format, args...))
+}
+
+func (r *recorder) Fatalf(format string, args ...interface{}) {
+	r.Errorf(format, args...)
+	runtime.Goexit()
+}
+
+// record runs f with a recorder and returns its failures.
+func record(t *testing.T, f func(tb testing.TB)) []string {
+	r := &recorder{TB: t}
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		f(r)
+	}()
+	<-done
+	return r.failures
+}
+
+func TestNotch(t *testing.T) {
+	src, err := ioutil.ReadFile("../examples/notch.dasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := Run(t, string(src)).ExpectReg("X", 0x40).ExpectMem(0x1000, 0x20)
+	p.ExpectReg("pc", p.Addr("crash"))
+}
+
+func TestFailures(t *testing.T) {
+	const src = `
+	SET X, 4
+	SET [result], 1
+:halt	SET PC, halt
+:result	DAT 0, 2
+`
+	failures := record(t, func(tb testing.TB) {
+		Run(tb, src).ExpectReg("X", 4).ExpectReg("X", 5).ExpectLabel("result", 1, 3).ExpectMem(0x1000, 0)
+	})
+	exp := []string{
+		"register X = 0x0004, want 0x0005\nregisters: A=0x0000 B=0x0000 C=0x0000 X=0x0004 Y=0x0000 Z=0x0000 I=0x0000 J=0x0000 SP=0x0000 O=0x0000 PC=0x0003",
+		"memory at result (0x0004) differs:\n-0x0004:    0x0001  [0x0002]\n+0x0004:    0x0001  [0x0003]\n",
+	}
+	if strings.Join(failures, "\n\n") != strings.Join(exp, "\n\n") {
+		t.Errorf("expected failures\n%s\ngot\n%s", strings.Join(exp, "\n\n"), strings.Join(failures, "\n\n"))
+	}
+
+	failures = record(t, func(tb testing.TB) {
+		(&Config{Cycles: 100}).Run(tb, ":loop ADD A, 1\nSET PC, loop")
+		tb.Errorf("not stopped")
+	})
+	if len(failures) != 1 || !strings.HasPrefix(failures[0], "dcputest: the program did not halt within 100 cycles, at ") {
+		t.Errorf("expected the program not to halt, got %q", failures)
+	}
+
+	failures = record(t, func(tb testing.TB) {
+		Run(tb, "SET A, 1\n:halt SET PC, halt").Reg("R")
+	})
+	if len(failures) != 1 || failures[0] != `dcputest: unknown register "R"` {
+		t.Errorf("expected an unknown register, got %q", failures)
+	}
+}
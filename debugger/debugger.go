@@ -3,7 +3,10 @@ package debugger
 import (
 	"github.com/xconstruct/dcpu16/disassembler"
 	"github.com/xconstruct/dcpu16/emulator"
+	"github.com/xconstruct/dcpu16/symbols"
+	"github.com/xconstruct/dcpu16/words"
 	"fmt"
+	"os"
 )
 
 // RDump outputs the current state of the registers.
@@ -14,9 +17,24 @@ func RDump(d *emulator.DCPU) {
 	fmt.Println()
 }
 
+// PrintMemory prints length words of the RAM from start, or all words up to
+// the end if length is 0, with their ASCII characters.
+func PrintMemory(d *emulator.DCPU, start, length int) {
+	words.Dump(os.Stdout, d.RAM[:], words.DumpOptions{Start: start, Length: length, Chars: words.ASCIIChars})
+}
+
 // PrintInstruction prints the instruction at PC.
 func PrintInstruction(d *emulator.DCPU) {
-	str, _ := disassembler.InstructionString(d.RAM[d.PC:])
+	PrintSymbolicInstruction(d, nil)
+}
+
+// PrintSymbolicInstruction prints the instruction at PC, preceded by the
+// symbol PC belongs to. Addresses of symbols are shown by name.
+func PrintSymbolicInstruction(d *emulator.DCPU, syms symbols.Map) {
+	str, _ := disassembler.SymbolicInstructionString(d.RAM[d.PC:], syms)
+	if name := syms.Name(d.PC); name != "" {
+		str = name + ": " + str
+	}
 	fmt.Println(str)
 }
 
@@ -2,7 +2,10 @@ package disassembler
 
 import (
 	"github.com/xconstruct/dcpu16/emulator"
+	"github.com/xconstruct/dcpu16/symbols"
+	"bufio"
 	"fmt"
+	"io"
 )
 
 var BasicOp = []string{
@@ -41,7 +44,18 @@ func OpString(level int, op byte) string {
 	return lookup[op]
 }
 
+// InstructionString formats the instruction at the start of mem and
+// returns the number of words it occupies.
 func InstructionString(mem []uint16) (str string, wordsRead int) {
+	return SymbolicInstructionString(mem, nil)
+}
+
+// SymbolicInstructionString formats the instruction like InstructionString,
+// but shows next word values that are the address of a symbol by name.
+func SymbolicInstructionString(mem []uint16, syms symbols.Map) (str string, wordsRead int) {
+	if len(mem) < 3 { // the instruction may be cut off at the end of memory
+		mem = append(append(make([]uint16, 0, 3), mem...), make([]uint16, 3-len(mem))...)
+	}
 	level, op, args := emulator.GetOp(mem[0])
 	str = OpString(level, op)
 
@@ -50,7 +64,7 @@ func InstructionString(mem []uint16) (str string, wordsRead int) {
 		if i > 0 {
 			str += ","
 		}
-		vStr, vWordsRead := ValueString(v, mem[wordsRead:])
+		vStr, vWordsRead := symbolicValueString(v, mem[wordsRead:], syms)
 		str += " " + vStr
 		wordsRead += vWordsRead
 	}
@@ -59,18 +73,28 @@ func InstructionString(mem []uint16) (str string, wordsRead int) {
 }
 
 func ValueString(v byte, mem []uint16) (str string, wordsRead int) {
+	return symbolicValueString(v, mem, nil)
+}
+
+func symbolicValueString(v byte, mem []uint16, syms symbols.Map) (str string, wordsRead int) {
+	word := func() string {
+		if sym, ok := syms.Lookup(mem[0]); ok {
+			return sym.Name
+		}
+		return fmt.Sprintf("%#04x", mem[0])
+	}
 	switch {
 	case v <= 0x07: return Registers[v], 0// register
 	case v <= 0x0f: return "["+Registers[v-0x08]+"]", 0 // [register]
 	case v <= 0x17:  // [next word + register]
-		return fmt.Sprintf("[%#04x+%s]", mem[1], Registers[v-0x10]), 1
+		return fmt.Sprintf("[%s+%s]", word(), Registers[v-0x10]), 1
 	case v == 0x18: return "POP", 0 // POP [SP++]
 	case v == 0x19: return "PEEK", 0 // PEEK [SP]
 	case v == 0x1a: return "PUSH", 0 // PUSH [--SP]
 	case v == 0x1c: return "PC", 0 // PC
 	case v == 0x1d: return "O", 0 // O
-	case v == 0x1e: return fmt.Sprintf("[%#04x]", mem[0]), 1 // [next word]
-	case v == 0x1f: return fmt.Sprintf("%#04x", mem[0]), 1 // next word (literal)
+	case v == 0x1e: return "[" + word() + "]", 1 // [next word]
+	case v == 0x1f: return word(), 1 // next word (literal)
 	}
 	return fmt.Sprintf("%#02x", v-0x20), 0 // literal value 0x00-0x1f (literal)
 }
@@ -78,10 +102,62 @@ func ValueString(v byte, mem []uint16) (str string, wordsRead int) {
 func Disassemble(mem []uint16) string {
 	str := ""
 	offset := 0
-	for offset <= len(mem) {
-		iStr, wordsRead := InstructionString(mem[offset:offset+3])
+	for offset < len(mem) {
+		iStr, wordsRead := InstructionString(mem[offset:])
 		str += iStr + "\n"
 		offset += wordsRead
 	}
 	return str
 }
+
+// Listing writes the disassembly of mem with the address and the words of
+// each instruction. Symbols are shown as labels, and the words of data
+// symbols of known size are shown as DAT.
+func Listing(w io.Writer, mem []uint16, syms symbols.Map) error {
+	bw := bufio.NewWriter(w)
+	dataEnd := 0
+	for offset := 0; offset < len(mem); {
+		next := len(mem) // address of the next symbol
+		for _, sym := range syms {
+			a := int(sym.Addr)
+			if a == offset {
+				fmt.Fprintf(bw, ":%s\n", sym.Name)
+				if sym.Kind == symbols.Data && sym.Size > 0 {
+					dataEnd = offset + sym.Size
+				} else if sym.Kind == symbols.Code {
+					dataEnd = 0
+				}
+			} else if a > offset && a < next {
+				next = a
+			}
+		}
+
+		var str string
+		n := 0
+		if offset < dataEnd {
+			for n < 8 && offset+n < dataEnd && offset+n < next {
+				n++
+			}
+			str = "DAT"
+			for i, v := range mem[offset:offset+n] {
+				if i > 0 {
+					str += ","
+				}
+				str += fmt.Sprintf(" %#04x", v)
+			}
+		} else {
+			str, n = SymbolicInstructionString(mem[offset:], syms)
+			if offset+n > len(mem) {
+				n = len(mem) - offset
+			}
+		}
+
+		code := fmt.Sprintf("%04x ", offset)
+		for _, v := range mem[offset:offset+n] {
+			code += fmt.Sprintf(" %04x", v)
+		}
+		fmt.Fprintf(bw, "%-21s  %s\n", code, str)
+		offset += n
+	}
+	return bw.Flush()
+}
@@ -30,14 +30,21 @@ type DCPU struct {
 	SP uint16
 	O uint16
 	offset int
+
+	// Cycles counts the cycles taken by the executed instructions.
+	Cycles uint64
+
+	// Tracer, if set, receives every instruction executed by Step.
+	Tracer Tracer
+	addr int // RAM address of the last value read, or -1
+	writes []MemWrite
 }
 
 // NewDCPU creates a new DCPU instance.
 func NewDCPU() (*DCPU) {
 	return &DCPU{
-		make([]uint16, 0x10000),
-		make([]uint16, 8),
-		0, 0, 0, 0,
+		RAM: make([]uint16, 0x10000),
+		R: make([]uint16, 8),
 	}
 }
 
@@ -47,6 +54,7 @@ func (d *DCPU) Reset() {
 	d.PC = 0
 	d.SP = 0
 	d.O = 0
+	d.Cycles = 0
 }
 
 // Load copies the mem word-array into the RAM
@@ -54,6 +62,12 @@ func (d *DCPU) Load(mem []uint16) {
 	copy(d.RAM, mem)
 }
 
+// LoadAt copies the mem word-array into the RAM, starting at addr.
+// Words beyond the end of the RAM are dropped.
+func (d *DCPU) LoadAt(mem []uint16, addr uint16) {
+	copy(d.RAM[addr:], mem)
+}
+
 // Exec runs the program saved in RAM until an error is encountered.
 func (d *DCPU) Exec() error {
 	for 0x0000 <= d.PC && d.PC <= 0xffff {
@@ -65,13 +79,64 @@ func (d *DCPU) Exec() error {
 	return nil
 }
 
+// Run executes the program until an instruction jumps to itself without
+// changing SP, which halts the program for good, until an error is encountered or until stop
+// is closed. It reports whether the program halted.
+func (d *DCPU) Run(stop <-chan bool) (halted bool, err error) {
+	return d.RunCycles(stop, 0)
+}
+
+// RunCycles executes the program like Run, but also stops once Cycles
+// reaches limit, unless limit is 0.
+func (d *DCPU) RunCycles(stop <-chan bool, limit uint64) (halted bool, err error) {
+	for limit == 0 || d.Cycles < limit {
+		select {
+		case <-stop:
+			return false, nil
+		default:
+		}
+		pc, sp := d.PC, d.SP
+		if err := d.Step(); err != nil {
+			return false, err
+		}
+		if d.PC == pc && d.SP == sp {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 // Step executes the next instruction in RAM.
 func (d *DCPU) Step() error {
+	if d.Tracer == nil {
+		return d.step()
+	}
+	before, words, cycles := d.registers(), d.instruction(), d.Cycles
+	d.writes = d.writes[:0]
+	if err := d.step(); err != nil {
+		return err
+	}
+	d.trace(words, before, int(d.Cycles-cycles))
+	return nil
+}
+
+// basicCycles are the cycles taken by the basic opcodes, without the
+// cycles for next words and failed tests.
+var basicCycles = [16]uint64{0, 1, 2, 2, 2, 3, 3, 2, 2, 1, 1, 1, 2, 2, 2, 2}
+
+func (d *DCPU) step() error {
 	word := d.nextWord()
 	level, op, args := GetOp(word)
+	d.Cycles += uint64(InstructionSize(word) - 1) // next words
+	switch {
+	case level == 0: d.Cycles += basicCycles[op]
+	case op == 0x01: d.Cycles += 2 // JSR
+	default:         d.Cycles += 1
+	}
 
 	if level == 0 { // basic opcodes
 		aV, aP:= d.readValue(args[0])
+		aAddr := d.addr
 		bV, _ := d.readValue(args[1])
 
 		if aP == nil && op <= 0xc { // fail silently for setting literal a
@@ -105,6 +170,9 @@ func (d *DCPU) Step() error {
 		case 0xe: if aV <= bV { d.stepIgnore() } // IFG
 		case 0xf: if (aV & bV) == 0 { d.stepIgnore() } // IFB
 		}
+		if d.Tracer != nil && op <= 0xb && aAddr >= 0 {
+			d.writes = append(d.writes, MemWrite{uint16(aAddr), *aP})
+		}
 
 		return nil
 	}
@@ -114,6 +182,9 @@ func (d *DCPU) Step() error {
 		aV, _ := d.readValue(args[0])
 		d.SP--
 		d.RAM[d.SP] = d.PC
+		if d.Tracer != nil {
+			d.writes = append(d.writes, MemWrite{d.SP, d.PC})
+		}
 		d.PC = aV
 		return nil
 	}
@@ -125,8 +196,10 @@ func (d *DCPU) Step() error {
 	return &UnknownOpError{d.PC, op}
 }
 
-// stepIgnore steps over the next instruction without executing it.
+// stepIgnore steps over the next instruction without executing it,
+// which takes a cycle.
 func (d *DCPU) stepIgnore() {
+	d.Cycles++
 	_, _, args := GetOp(d.nextWord())
 	for _, v := range(args) {
 		d.readValueIgnore(v)
@@ -135,17 +208,19 @@ func (d *DCPU) stepIgnore() {
 
 // readValue parses a value code and returns the referenced value and,
 // if applicable, a pointer to write to this location. May modify PC / SP.
+// The address of a location in RAM is kept in d.addr.
 func (d *DCPU) readValue(v byte) (word uint16, ptr *uint16) {
+	d.addr = -1
 	switch {
 	case v <= 0x07: ptr = &d.R[v] // register
-	case v <= 0x0f: ptr = &d.RAM[d.R[v-0x08]] // [register]
-	case v <= 0x17: ptr = &d.RAM[d.nextWord() + d.R[v-0x10]] // [next word + register]
-	case v == 0x18: ptr = &d.RAM[d.SP]; d.SP++; // POP [SP++]
-	case v == 0x19: ptr = &d.RAM[d.SP] // PEEK [SP]
-	case v == 0x1a: d.SP--; ptr = &d.RAM[d.SP] // PUSH [--SP]
+	case v <= 0x0f: ptr = d.ram(d.R[v-0x08]) // [register]
+	case v <= 0x17: ptr = d.ram(d.nextWord() + d.R[v-0x10]) // [next word + register]
+	case v == 0x18: ptr = d.ram(d.SP); d.SP++; // POP [SP++]
+	case v == 0x19: ptr = d.ram(d.SP) // PEEK [SP]
+	case v == 0x1a: d.SP--; ptr = d.ram(d.SP) // PUSH [--SP]
 	case v == 0x1c: ptr = &d.PC // PC
 	case v == 0x1d: ptr = &d.O // O
-	case v == 0x1e: ptr = &d.RAM[d.nextWord()] // [next word]
+	case v == 0x1e: ptr = d.ram(d.nextWord()) // [next word]
 	case v == 0x1f: word = d.nextWord() // next word (literal)
 	default:        word = uint16(v-0x20) // literal value 0x00-0x1f (literal)
 	}
@@ -155,6 +230,12 @@ func (d *DCPU) readValue(v byte) (word uint16, ptr *uint16) {
 	return word, ptr
 }
 
+// ram returns a pointer to the word at addr and keeps addr in d.addr.
+func (d *DCPU) ram(addr uint16) *uint16 {
+	d.addr = int(addr)
+	return &d.RAM[addr]
+}
+
 // readValueIgnore parses a value code and fetches the next word if needed
 // without modifying SP.
 func (d *DCPU) readValueIgnore(v byte) {
@@ -1,6 +1,8 @@
 package emulator
 
 import (
+	"bytes"
+	"reflect"
 	"testing"
 )
 
@@ -34,3 +36,124 @@ func TestInvalidCode(t *testing.T) {
 		t.Errorf("Expected UnknownOpError, but got: %s\n", e)
 	}
 }
+
+func TestRun(t *testing.T) {
+	dcpu := NewDCPU()
+	dcpu.Load(notchMem)
+	halted, err := dcpu.Run(nil)
+	if err != nil || !halted {
+		t.Fatalf("expected the program to halt, got %v, %v", halted, err)
+	}
+	if dcpu.PC != 0x001a {
+		t.Errorf("PC: got 0x%04x, want 0x001a", dcpu.PC)
+	}
+
+	stop := make(chan bool)
+	close(stop)
+	dcpu.Load(notchMem)
+	dcpu.Reset()
+	if halted, err := dcpu.Run(stop); halted || err != nil || dcpu.PC != 0 {
+		t.Errorf("expected the program to stop at once, got %v, %v at 0x%04x", halted, err, dcpu.PC)
+	}
+}
+
+func TestSaveState(t *testing.T) {
+	dcpu := NewDCPU()
+	dcpu.Load(notchMem)
+	for dcpu.PC != 0x000d {
+		dcpu.Step()
+	}
+	var buf bytes.Buffer
+	if err := dcpu.SaveState(&buf); err != nil {
+		t.Fatal(err)
+	}
+	state := buf.Bytes()
+
+	// unknown chunks are skipped
+	extended := append([]byte{}, state...)
+	extended = append(extended, "DEV \x00\x00\x00\x02\x12\x34"...)
+	restored := NewDCPU()
+	if err := restored.LoadState(bytes.NewReader(extended)); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(dcpu.RAM, restored.RAM) || !reflect.DeepEqual(dcpu.R, restored.R) ||
+		dcpu.PC != restored.PC || dcpu.SP != restored.SP || dcpu.O != restored.O ||
+		dcpu.Cycles != restored.Cycles {
+		t.Errorf("restored state differs from the saved one")
+	}
+
+	for _, c := range []struct {
+		data []byte
+		err  string
+	}{
+		{[]byte("DCPU"), "dcpu/emulator: not a save state"},
+		{state[:len(state)-1], "dcpu/emulator: truncated save state"},
+		{append([]byte("DCPS\x00\x02"), state[6:]...), "dcpu/emulator: unsupported save state version 2"},
+		{state[:6], "dcpu/emulator: save state lacks the CPU or RAM"},
+	} {
+		d := NewDCPU()
+		if err := d.LoadState(bytes.NewReader(c.data)); err == nil || err.Error() != c.err {
+			t.Errorf("expected error %q, got %v", c.err, err)
+		}
+	}
+}
+
+type recorder []TraceStep
+
+func (r *recorder) Trace(s *TraceStep) {
+	*r = append(*r, *s)
+	(*r)[len(*r)-1].Writes = append([]MemWrite{}, s.Writes...)
+}
+
+func TestTrace(t *testing.T) {
+	var steps recorder
+	dcpu := NewDCPU()
+	dcpu.Tracer = &steps
+	dcpu.Load(notchMem)
+	for i := 0; i < 4; i++ {
+		dcpu.Step()
+	}
+	exp := recorder{
+		{0x0000, []uint16{0x7c01, 0x0030}, []RegChange{{0, 0x0030}}, []MemWrite{}, 2},
+		{0x0002, []uint16{0x7de1, 0x1000, 0x0020}, nil, []MemWrite{{0x1000, 0x0020}}, 3},
+		{0x0005, []uint16{0x7803, 0x1000}, []RegChange{{0, 0x0010}}, []MemWrite{}, 3},
+		{0x0007, []uint16{0xc00d}, []RegChange{{RegPC, 0x000a}}, []MemWrite{}, 3},
+	}
+	if !reflect.DeepEqual(steps, exp) {
+		t.Errorf("expected %v, got %v", exp, steps)
+	}
+
+	// JSR pushes the return address
+	steps = steps[:0]
+	dcpu.Load([]uint16{0x7c10, 0x0005})
+	dcpu.Reset()
+	dcpu.Step()
+	exp = recorder{
+		{0x0000, []uint16{0x7c10, 0x0005}, []RegChange{{RegSP, 0xffff}, {RegPC, 0x0005}}, []MemWrite{{0xffff, 0x0002}}, 3},
+	}
+	if !reflect.DeepEqual(steps, exp) {
+		t.Errorf("expected %v, got %v", exp, steps)
+	}
+}
+
+func TestCycles(t *testing.T) {
+	dcpu := NewDCPU()
+	dcpu.Load([]uint16{
+		0x8401,         // SET A, 1          1 cycle
+		0x7802, 0x1000, // ADD A, [0x1000]   3 cycles
+		0x940c,         // IFE A, 5          3 cycles, as the test fails
+		0x7c01, 0x1234, // SET A, 0x1234     skipped
+		0x7c10, 0x0008, // JSR 8             3 cycles
+	})
+	for dcpu.PC != 0x0008 {
+		dcpu.Step()
+	}
+	if dcpu.Cycles != 10 {
+		t.Errorf("expected 10 cycles, got %d", dcpu.Cycles)
+	}
+
+	dcpu.Reset()
+	if halted, err := dcpu.RunCycles(nil, 4); halted || err != nil || dcpu.Cycles != 4 {
+		t.Errorf("expected to stop after 4 cycles, got %v, %v after %d", halted, err, dcpu.Cycles)
+	}
+}
@@ -0,0 +1,148 @@
+package emulator
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// A save state holds the complete state of a DCPU, so that a session can be
+// resumed later. It is encoded as big-endian values in chunks, so that the
+// state of devices can be added in chunks of their own:
+//
+//	magic     "DCPS"
+//	version   uint16
+//	chunks    for each: id [4]byte, uint32 length, data
+//
+// The chunks of version 1 are:
+//
+//	"CPU "    registers A to J, PC, SP and O as uint16
+//	"RAM "    the words of the RAM
+//	"CYC "    the cycle count as four uint16, most significant first
+//
+// Unknown chunks are skipped, so that older emulators can read the
+// states of newer ones as long as the version is unchanged.
+const (
+	stateMagic   = "DCPS"
+	stateVersion = 1
+)
+
+// SaveState writes the state of the DCPU to w.
+func (d *DCPU) SaveState(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString(stateMagic)
+	binary.Write(bw, binary.BigEndian, uint16(stateVersion))
+
+	cpu := make([]uint16, 0, len(d.R)+3)
+	cpu = append(cpu, d.R...)
+	cpu = append(cpu, d.PC, d.SP, d.O)
+	writeChunk(bw, "CPU ", cpu)
+	writeChunk(bw, "RAM ", d.RAM)
+	c := d.Cycles
+	writeChunk(bw, "CYC ", []uint16{uint16(c >> 48), uint16(c >> 32), uint16(c >> 16), uint16(c)})
+	return bw.Flush()
+}
+
+func writeChunk(w io.Writer, id string, data []uint16) {
+	w.Write([]byte(id))
+	binary.Write(w, binary.BigEndian, uint32(2*len(data)))
+	binary.Write(w, binary.BigEndian, data)
+}
+
+// LoadState replaces the state of the DCPU with the state read from r.
+// The DCPU is unchanged if the state cannot be read.
+func (d *DCPU) LoadState(r io.Reader) error {
+	br := bufio.NewReader(r)
+	head := make([]byte, len(stateMagic))
+	if _, err := io.ReadFull(br, head); err != nil || string(head) != stateMagic {
+		return errors.New("dcpu/emulator: not a save state")
+	}
+	var version uint16
+	if err := binary.Read(br, binary.BigEndian, &version); err != nil {
+		return errors.New("dcpu/emulator: truncated save state")
+	}
+	if version != stateVersion {
+		return errors.New(fmt.Sprintf("dcpu/emulator: unsupported save state version %d", version))
+	}
+
+	var cpu, ram, cycles []uint16
+	for {
+		id := make([]byte, 4)
+		if _, err := io.ReadFull(br, id); err == io.EOF {
+			break
+		} else if err != nil {
+			return errors.New("dcpu/emulator: truncated save state")
+		}
+		var size uint32
+		if err := binary.Read(br, binary.BigEndian, &size); err != nil {
+			return errors.New("dcpu/emulator: truncated save state")
+		}
+		switch string(id) {
+		case "CPU ", "RAM ", "CYC ":
+			if size%2 != 0 || size > 2*0x10000 {
+				return errors.New(fmt.Sprintf("dcpu/emulator: invalid %q chunk in save state", id))
+			}
+			data := make([]uint16, size/2)
+			if err := binary.Read(br, binary.BigEndian, data); err != nil {
+				return errors.New("dcpu/emulator: truncated save state")
+			}
+			switch string(id) {
+			case "CPU ":
+				cpu = data
+			case "RAM ":
+				ram = data
+			default:
+				cycles = data
+			}
+		default:
+			if _, err := io.CopyN(ioutil.Discard, br, int64(size)); err != nil {
+				return errors.New("dcpu/emulator: truncated save state")
+			}
+		}
+	}
+	if len(cpu) != len(d.R)+3 || len(ram) != len(d.RAM) {
+		return errors.New("dcpu/emulator: save state lacks the CPU or RAM")
+	}
+	if cycles != nil && len(cycles) != 4 {
+		return errors.New(`dcpu/emulator: invalid "CYC " chunk in save state`)
+	}
+
+	copy(d.R, cpu)
+	d.PC, d.SP, d.O = cpu[len(d.R)], cpu[len(d.R)+1], cpu[len(d.R)+2]
+	copy(d.RAM, ram)
+	d.Cycles = 0
+	for _, v := range cycles {
+		d.Cycles = d.Cycles<<16 | uint64(v)
+	}
+	return nil
+}
+
+// SaveStateFile writes the state of the DCPU into the named file.
+func (d *DCPU) SaveStateFile(filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err = d.SaveState(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// LoadStateFile reads the state of the DCPU from the named file.
+func (d *DCPU) LoadStateFile(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err = d.LoadState(file); err != nil {
+		return errors.New(fmt.Sprintf("%s: %s", filename, err))
+	}
+	return nil
+}
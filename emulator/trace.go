@@ -0,0 +1,91 @@
+package emulator
+
+// Registers of a RegChange besides A to J, which are 0 to 7.
+const (
+	RegSP = 8 + iota
+	RegO
+	RegPC
+)
+
+// Tracer receives the instructions executed by a DCPU.
+type Tracer interface {
+	Trace(s *TraceStep)
+}
+
+// TraceStep describes an executed instruction and its effects.
+// It is only valid during the call to Trace.
+type TraceStep struct {
+	PC     uint16      // address of the instruction
+	Words  []uint16    // words of the instruction
+	Regs   []RegChange // registers that changed, in the order of their numbers
+	Writes []MemWrite  // words written to the RAM, in order
+	Cycles int         // cycles taken by the instruction
+}
+
+// RegChange records the new value of a register. PC is only recorded if
+// it does not continue with the following instruction, as after jumps
+// and skipped instructions.
+type RegChange struct {
+	Reg   int
+	Value uint16
+}
+
+// MemWrite records a word written to the RAM.
+type MemWrite struct {
+	Addr  uint16
+	Value uint16
+}
+
+// registers returns the registers A to J, SP, O and PC in the order of
+// their numbers in RegChange.
+func (d *DCPU) registers() []uint16 {
+	r := make([]uint16, 0, len(d.R)+3)
+	r = append(r, d.R...)
+	return append(r, d.SP, d.O, d.PC)
+}
+
+// Register returns the value of a register, numbered as in RegChange.
+func (d *DCPU) Register(n int) uint16 {
+	return d.registers()[n]
+}
+
+// instruction returns the words of the instruction at PC.
+func (d *DCPU) instruction() []uint16 {
+	words := make([]uint16, InstructionSize(d.RAM[d.PC]))
+	for i := range words {
+		words[i] = d.RAM[d.PC+uint16(i)]
+	}
+	return words
+}
+
+// trace passes an instruction to the tracer, after it was executed
+// by a DCPU with the given registers.
+func (d *DCPU) trace(words []uint16, before []uint16, cycles int) {
+	pc := before[RegPC]
+	s := &TraceStep{PC: pc, Words: words, Writes: d.writes, Cycles: cycles}
+	after := d.registers()
+	after[RegPC] -= pc + uint16(len(words))
+	before[RegPC] = 0
+	for i, v := range after {
+		if v != before[i] {
+			if i == RegPC {
+				v = d.PC
+			}
+			s.Regs = append(s.Regs, RegChange{i, v})
+		}
+	}
+	d.Tracer.Trace(s)
+}
+
+// InstructionSize returns the number of words of the instruction
+// starting with word.
+func InstructionSize(word uint16) int {
+	_, _, args := GetOp(word)
+	size := 1
+	for _, v := range args {
+		if (v >= 0x10 && v <= 0x17) || v == 0x1e || v == 0x1f {
+			size++
+		}
+	}
+	return size
+}
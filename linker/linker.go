@@ -0,0 +1,169 @@
+// Package linker combines relocatable objects into a program.
+package linker
+
+import (
+	"github.com/xconstruct/dcpu16/object"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrorList is a list of linker errors.
+type ErrorList []error
+
+// Error lists all errors, one per line.
+func (l ErrorList) Error() string {
+	s := make([]string, len(l))
+	for i, e := range l {
+		s[i] = e.Error()
+	}
+	return strings.Join(s, "\n")
+}
+
+func (l *ErrorList) add(format string, args ...interface{}) {
+	*l = append(*l, errors.New(fmt.Sprintf("linker: "+format, args...)))
+}
+
+// symbol is an exported symbol with the object defining it.
+type symbol struct {
+	obj *object.File
+	sym object.Symbol
+}
+
+// Link lays out the sections of all objects and resolves their symbols,
+// which returns a program that is loaded at address 0. Sections with the
+// same name are placed together, in the order in which the names first
+// appear, and within a name in the order of the objects. All unresolved
+// and duplicate symbols are reported.
+func Link(objs []*object.File) (gen []uint16, err error) {
+	var errs ErrorList
+
+	// collect the exported symbols
+	symbols := make(map[string]symbol)
+	for _, obj := range objs {
+		for _, sym := range obj.Symbols {
+			if prev, ok := symbols[sym.Name]; ok {
+				errs.add(`symbol "%s" defined in both %s and %s`, sym.Name, name(prev.obj), name(obj))
+				continue
+			}
+			symbols[sym.Name] = symbol{obj, sym}
+		}
+	}
+
+	// place the sections
+	bases, end := layout(objs)
+	if end > 0x10000 {
+		errs.add("program of %d words exceeds the address space", end)
+		return nil, errs
+	}
+
+	// copy the sections and relocate their words
+	gen = make([]uint16, end)
+	undefined := make(map[string]bool)
+	for _, obj := range objs {
+		base := bases[obj]
+		for i, s := range obj.Sections {
+			copy(gen[base[i]:], s.Data)
+			for _, r := range s.Relocs {
+				var addr int
+				if r.Section >= 0 {
+					addr = base[r.Section]
+				} else if def, ok := symbols[r.Symbol]; ok {
+					addr = int(def.sym.Value)
+					if def.sym.Section >= 0 {
+						addr += bases[def.obj][def.sym.Section]
+					}
+				} else {
+					key := name(obj) + "\x00" + r.Symbol
+					if !undefined[key] {
+						undefined[key] = true
+						errs.add(`undefined symbol "%s" referenced in %s`, r.Symbol, name(obj))
+					}
+					continue
+				}
+				gen[base[i]+int(r.Offset)] += uint16(addr)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return gen, nil
+}
+
+// LinkArchives links the objects like Link, together with the members of
+// the archives that define symbols which would be undefined otherwise.
+// The archives are searched in order until no more members are needed,
+// so that members may refer to each other and to other archives.
+func LinkArchives(objs []*object.File, libs []*object.Archive) (gen []uint16, err error) {
+	all := make([]*object.File, 0, len(objs))
+	defined := make(map[string]bool)
+	used := make(map[*object.File]bool)
+	add := func(obj *object.File) {
+		all = append(all, obj)
+		used[obj] = true
+		for _, sym := range obj.Symbols {
+			defined[sym.Name] = true
+		}
+	}
+	for _, obj := range objs {
+		add(obj)
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for _, lib := range libs {
+			for i := 0; i < len(all); i++ {
+				for _, name := range all[i].Imports() {
+					j, ok := lib.Index[name]
+					if ok && !defined[name] && !used[lib.Members[j]] {
+						add(lib.Members[j])
+						changed = true
+					}
+				}
+			}
+		}
+	}
+	return Link(all)
+}
+
+// layout assigns an address to each section and returns them by object,
+// together with the end of the program.
+func layout(objs []*object.File) (bases map[*object.File][]int, end int) {
+	names := make([]string, 0)
+	seen := make(map[string]bool)
+	bases = make(map[*object.File][]int)
+	for _, obj := range objs {
+		bases[obj] = make([]int, len(obj.Sections))
+		for _, s := range obj.Sections {
+			if !seen[s.Name] {
+				seen[s.Name] = true
+				names = append(names, s.Name)
+			}
+		}
+	}
+
+	for _, n := range names {
+		for _, obj := range objs {
+			for i, s := range obj.Sections {
+				if s.Name != n {
+					continue
+				}
+				if s.Align > 1 {
+					end += (s.Align - end%s.Align) % s.Align
+				}
+				bases[obj][i] = end
+				end += len(s.Data)
+			}
+		}
+	}
+	return bases, end
+}
+
+// name returns the name of an object for error messages.
+func name(obj *object.File) string {
+	if obj.Name == "" {
+		return "<object>"
+	}
+	return obj.Name
+}
@@ -0,0 +1,118 @@
+package linker
+
+import (
+	"github.com/xconstruct/dcpu16/assembler"
+	"github.com/xconstruct/dcpu16/object"
+	"strings"
+	"testing"
+)
+
+const mainSrc = `
+.global start
+:start	JSR print
+	SET A, message
+:loop	SET PC, loop
+.section data
+:message DAT 1, 2
+`
+
+const libSrc = `
+.global print
+.section data
+:greeting DAT 3
+.section text
+:print	SET B, greeting
+	SET PC, POP
+`
+
+func assemble(t *testing.T, name, src string) *object.File {
+	obj, err := (&assembler.Config{}).AssembleObject([]byte(src))
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	obj.Name = name
+	return obj
+}
+
+func TestLink(t *testing.T) {
+	main, lib := assemble(t, "main.o", mainSrc), assemble(t, "lib.o", libSrc)
+	gen, err := Link([]*object.File{main, lib})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []uint16{
+		0x7c10, 0x0006, // JSR print
+		0x7c01, 0x0009, // SET A, message
+		0x7dc1, 0x0004, // SET PC, loop
+		0x7c11, 0x000b, // SET B, greeting
+		0x61c1,         // SET PC, POP
+		0x0001, 0x0002, // main data
+		0x0003,         // lib data
+	}
+	if len(gen) != len(exp) {
+		t.Fatalf("expected %d words, got %d: %04x", len(exp), len(gen), gen)
+	}
+	for i := range exp {
+		if gen[i] != exp[i] {
+			t.Errorf("word %d: expected %04x, got %04x", i, exp[i], gen[i])
+		}
+	}
+}
+
+func TestLinkErrors(t *testing.T) {
+	main, lib := assemble(t, "main.o", mainSrc), assemble(t, "lib.o", libSrc)
+	for _, c := range []struct {
+		objs []*object.File
+		msg string
+	}{
+		{[]*object.File{main}, `linker: undefined symbol "print" referenced in main.o`},
+		{[]*object.File{main, lib, lib}, `linker: symbol "print" defined in both lib.o and lib.o`},
+	} {
+		_, err := Link(c.objs)
+		if err == nil || !strings.Contains(err.Error(), c.msg) {
+			t.Errorf("expected error %q, got %v", c.msg, err)
+		}
+	}
+}
+
+func TestLinkArchives(t *testing.T) {
+	main := assemble(t, "main.o", `
+	JSR print
+:halt	SET PC, halt
+`)
+	print := assemble(t, "print.o", `
+.global print
+:print	JSR putc
+	SET PC, POP
+`)
+	putc := assemble(t, "putc.o", `
+.global putc
+:putc	SET [0x8000], A
+	SET PC, POP
+`)
+	unused := assemble(t, "unused.o", `
+.global unused
+:unused	SET PC, POP
+`)
+	lib := object.NewArchive([]*object.File{unused, putc, print})
+	gen, err := LinkArchives([]*object.File{main}, []*object.Archive{lib})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []uint16{
+		0x7c10, 0x0004, // JSR print
+		0x7dc1, 0x0002, // SET PC, halt
+		0x7c10, 0x0007, // :print JSR putc
+		0x61c1,         // SET PC, POP
+		0x01e1, 0x8000, // :putc SET [0x8000], A
+		0x61c1,         // SET PC, POP
+	}
+	if len(gen) != len(exp) {
+		t.Fatalf("expected %d words, got %d: %04x", len(exp), len(gen), gen)
+	}
+	for i := range exp {
+		if gen[i] != exp[i] {
+			t.Errorf("word %d: expected %04x, got %04x", i, exp[i], gen[i])
+		}
+	}
+}
@@ -0,0 +1,123 @@
+// Package loader loads relocatable programs at any address of the memory,
+// so that several programs can share the RAM of one DCPU.
+//
+// A relocatable program is assembled for address 0 and lists the words
+// that hold an address. When the program is loaded at another address,
+// that address is added to each of these words.
+//
+// The encoding consists of big-endian words, which allows a loader
+// running on the DCPU itself to read it:
+//
+//	magic       0x4443 0x5052 ("DCPR")
+//	version     1
+//	length      two words, high word first
+//	relocations two words with their count, high word first
+//	image       the words of the program
+//	relocations the offset of each word that holds an address
+package loader
+
+import (
+	"github.com/xconstruct/dcpu16/emulator"
+	"github.com/xconstruct/dcpu16/words"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+var magic = []uint16{0x4443, 0x5052}
+
+const (
+	version    = 1
+	headerSize = 7
+)
+
+// Program is a relocatable program.
+type Program struct {
+	Image  []uint16 // the program for address 0
+	Relocs []uint16 // offsets of the words in Image that hold an address
+}
+
+// Relocate returns a copy of the image for loading at base.
+func (p *Program) Relocate(base uint16) []uint16 {
+	mem := make([]uint16, len(p.Image))
+	copy(mem, p.Image)
+	for _, offs := range p.Relocs {
+		mem[offs] += base
+	}
+	return mem
+}
+
+// Load places the program at base in the RAM of the DCPU and adds base
+// to all words that hold an address. The program must fit into the RAM
+// without wrapping around.
+func Load(d *emulator.DCPU, p *Program, base uint16) error {
+	if int(base)+len(p.Image) > len(d.RAM) {
+		return errors.New(fmt.Sprintf("loader: program of %d words does not fit at %#04x", len(p.Image), base))
+	}
+	if err := p.check(); err != nil {
+		return err
+	}
+	d.LoadAt(p.Relocate(base), base)
+	return nil
+}
+
+// check ensures that all relocations lie within the image.
+func (p *Program) check() error {
+	for _, offs := range p.Relocs {
+		if int(offs) >= len(p.Image) {
+			return errors.New(fmt.Sprintf("loader: relocation at %#04x lies outside of the program", offs))
+		}
+	}
+	return nil
+}
+
+// IsRelocatable reports whether data starts like an encoded
+// relocatable program.
+func IsRelocatable(data []byte) bool {
+	head := make([]uint16, len(magic))
+	return words.CopyFromBytes(head, data) == 2*len(magic) && head[0] == magic[0] && head[1] == magic[1]
+}
+
+// Write encodes the program into w.
+func (p *Program) Write(w io.Writer) error {
+	mem := make([]uint16, 0, headerSize+len(p.Image)+len(p.Relocs))
+	mem = append(mem, magic...)
+	mem = append(mem, version)
+	mem = append(mem, uint16(len(p.Image)>>16), uint16(len(p.Image)))
+	mem = append(mem, uint16(len(p.Relocs)>>16), uint16(len(p.Relocs)))
+	mem = append(mem, p.Image...)
+	mem = append(mem, p.Relocs...)
+	_, err := io.Copy(w, words.NewReadWriter(mem))
+	return err
+}
+
+// Read decodes a program from r.
+func Read(r io.Reader) (*Program, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if !IsRelocatable(data) {
+		return nil, errors.New("loader: not a relocatable program")
+	}
+	mem := make([]uint16, (len(data)+1)/2)
+	words.CopyFromBytes(mem, data)
+	if len(mem) < headerSize {
+		return nil, errors.New("loader: truncated program")
+	}
+	if mem[2] != version {
+		return nil, errors.New(fmt.Sprintf("loader: unsupported version %d", mem[2]))
+	}
+	n := int(mem[3])<<16 | int(mem[4])
+	nrel := int(mem[5])<<16 | int(mem[6])
+	if n > 0x10000 || len(mem) != headerSize+n+nrel {
+		return nil, errors.New("loader: length of the program does not match its header")
+	}
+	mem = mem[headerSize:]
+	p := &Program{Image: mem[:n], Relocs: mem[n:]}
+	if err := p.check(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
@@ -0,0 +1,68 @@
+package loader
+
+import (
+	"github.com/xconstruct/dcpu16/emulator"
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+var prog = &Program{
+	Image: []uint16{
+		0x7dc1, 0x0003, // SET PC, start
+		0x0000,
+		0x7801, 0x0007, // :start SET A, [value]
+		0x7dc1, 0x0005, // :halt SET PC, halt
+		0x1234,         // :value
+	},
+	Relocs: []uint16{1, 4, 6},
+}
+
+func TestLoad(t *testing.T) {
+	dcpu := emulator.NewDCPU()
+	if err := Load(dcpu, prog, 0x1000); err != nil {
+		t.Fatal(err)
+	}
+	dcpu.PC = 0x1000
+	for i := 0; i < 3; i++ {
+		if err := dcpu.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if dcpu.PC != 0x1005 || dcpu.R[0] != 0x1234 {
+		t.Errorf("expected PC 0x1005 and A 0x1234, got %#04x and %#04x", dcpu.PC, dcpu.R[0])
+	}
+	if prog.Image[1] != 0x0003 {
+		t.Errorf("Load modified the program")
+	}
+
+	if err := Load(dcpu, prog, 0xfffc); err == nil {
+		t.Errorf("expected an error for a program that does not fit")
+	}
+}
+
+func TestReadWrite(t *testing.T) {
+	var buf bytes.Buffer
+	if err := prog.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !IsRelocatable(buf.Bytes()) {
+		t.Errorf("written program is not recognized as relocatable")
+	}
+	p, err := Read(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p, prog) {
+		t.Errorf("expected %v, got %v", prog, p)
+	}
+
+	for _, data := range [][]byte{
+		{0x7d, 0xc1, 0x00, 0x03},
+		buf.Bytes()[:buf.Len()-2],
+	} {
+		if _, err := Read(bytes.NewReader(data)); err == nil {
+			t.Errorf("expected an error for % x", data)
+		}
+	}
+}
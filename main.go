@@ -1,16 +1,32 @@
 package main
 
 import (
+	"github.com/xconstruct/dcpu16/asmtest"
 	"github.com/xconstruct/dcpu16/assembler"
+	"github.com/xconstruct/dcpu16/coverage"
 	"github.com/xconstruct/dcpu16/debugger"
+	"github.com/xconstruct/dcpu16/disassembler"
 	"github.com/xconstruct/dcpu16/emulator"
+	"github.com/xconstruct/dcpu16/linker"
+	"github.com/xconstruct/dcpu16/loader"
+	"github.com/xconstruct/dcpu16/object"
+	"github.com/xconstruct/dcpu16/profile"
+	"github.com/xconstruct/dcpu16/sourcemap"
+	"github.com/xconstruct/dcpu16/symbols"
+	"github.com/xconstruct/dcpu16/trace"
 	"github.com/xconstruct/dcpu16/words"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"io"
 	"io/ioutil"
 	"bufio"
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
 )
 
 func assert(err error) {
@@ -42,6 +58,22 @@ func main() {
 	case "h": fallthrough
 	case "hexdump":
 		runHexdump()
+	case "l": fallthrough
+	case "link":
+		runLinker()
+	case "ar":
+		runArchiver()
+	case "tracediff":
+		runTraceDiff()
+	case "p": fallthrough
+	case "profile":
+		runProfiler()
+	case "c": fallthrough
+	case "coverage":
+		runCoverage()
+	case "t": fallthrough
+	case "test":
+		runTests()
 	default:
 		if len(os.Args) > 2 {
 			printHelp(os.Args[2]);
@@ -52,40 +84,127 @@ func main() {
 }
 
 func runEmulator() {
-	flag.Parse()
-	path := flag.Arg(1)
-	if path == "" {
+	flags := flag.NewFlagSet("emulate", flag.ExitOnError)
+	base := flags.String("base", "0", "load the program at this address")
+	format := flags.String("format", "", "format of the program: big, little, hex or ihex (default: detect)")
+	loadState := flags.String("load-state", "", "resume the save state in this file instead of loading a program")
+	saveState := flags.String("save-state-on-exit", "", "save the state to this file when the emulation stops")
+	tracePath := flags.String("trace", "", "write a trace of the executed instructions to this file")
+	traceFormat := flags.String("trace-format", "text", "format of the trace: text or binary")
+	flags.Parse(os.Args[2:])
+	path := flags.Arg(0)
+	if (path == "") == (*loadState == "") {
 		printHelp("emulate")
 		return
 	}
 
-	file, err := os.Open(path)
-	assert(err)
-
 	dcpu := emulator.NewDCPU()
-	ram := words.NewReadWriter(dcpu.RAM)
-	_, err = io.Copy(ram, file)
-	file.Close()
-	assert(err)
-	err = dcpu.Exec()
-	assert(err)
+	if *loadState != "" {
+		assert(dcpu.LoadStateFile(*loadState))
+	} else {
+		assert(loadProgram(dcpu, path, *base, *format))
+	}
+
+	var tracer *trace.Writer
+	var traceFile *os.File
+	if *tracePath != "" {
+		f, err := trace.ParseFormat(*traceFormat)
+		assert(err)
+		traceFile, err = os.Create(*tracePath)
+		assert(err)
+		tracer = trace.NewWriter(traceFile, f)
+		dcpu.Tracer = tracer
+	}
+
+	_, err := dcpu.Run(interrupted())
+	// the trace and the state are most useful when the emulation failed,
+	// so they are written before exiting
+	if tracer != nil {
+		assert(tracer.Flush())
+		assert(traceFile.Close())
+	}
+	if *saveState != "" {
+		assert(dcpu.SaveStateFile(*saveState))
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// loadProgram loads the program file at the base address and starts it
+// there. Relocatable programs are relocated to the base address, while
+// plain images are copied as they are.
+func loadProgram(dcpu *emulator.DCPU, path string, base string, format string) error {
+	addr, err := strconv.ParseUint(base, 0, 16)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if format == "" && loader.IsRelocatable(data) {
+		prog, err := loader.Read(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		if err = loader.Load(dcpu, prog, uint16(addr)); err != nil {
+			return err
+		}
+	} else {
+		mem, err := decodeImage(data, format)
+		if err != nil {
+			return err
+		}
+		dcpu.LoadAt(mem, uint16(addr))
+	}
+	dcpu.PC = uint16(addr)
+	return nil
+}
+
+// decodeImage decodes a memory image in the named format,
+// or in the detected format if the name is empty.
+func decodeImage(data []byte, format string) ([]uint16, error) {
+	f := words.DetectFormat(data)
+	if format != "" {
+		var err error
+		if f, err = words.ParseFormat(format); err != nil {
+			return nil, err
+		}
+	}
+	return words.Decode(data, f)
+}
+
+// readImage reads a memory image like decodeImage.
+func readImage(path string, format string) ([]uint16, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decodeImage(data, format)
 }
 
 func runDebugger() {
-	flag.Parse()
-	path := flag.Arg(1)
-	if path == "" {
+	flags := flag.NewFlagSet("debug", flag.ExitOnError)
+	base := flags.String("base", "0", "load the program at this address")
+	symbolsPath := flags.String("symbols", "", "read symbols from this symbol map")
+	format := flags.String("format", "", "format of the program: big, little, hex or ihex (default: detect)")
+	loadState := flags.String("load-state", "", "resume the save state in this file instead of loading a program")
+	flags.Parse(os.Args[2:])
+	path := flags.Arg(0)
+	if (path == "") == (*loadState == "") {
 		printHelp("debug")
 		return
 	}
 
-	file, err := os.Open(path)
-	assert(err)
-
 	dcpu := emulator.NewDCPU()
-	ram := words.NewReadWriter(dcpu.RAM)
-	_, err = io.Copy(ram, file)
-	file.Close()
+	if *loadState != "" {
+		assert(dcpu.LoadStateFile(*loadState))
+	} else {
+		assert(loadProgram(dcpu, path, *base, *format))
+	}
+	syms, err := readSymbols(*symbolsPath)
 	assert(err)
 
 	in := bufio.NewReader(os.Stdin)
@@ -98,7 +217,11 @@ func runDebugger() {
 		}
 		assert(err)
 
-		switch (line) {
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+		switch (args[0]) {
 		case "quit": return
 		case "step":
 			err := dcpu.Step()
@@ -115,66 +238,670 @@ func runDebugger() {
 			if err != nil {
 				fmt.Println("dcpu err: ", err)
 			}
-		case "mem": words.Hexdump(dcpu.RAM, os.Stdout)
+		case "mem":
+			var addr [2]uint64
+			for i := 1; i < len(args) && i <= 2 && err == nil; i++ {
+				addr[i-1], err = strconv.ParseUint(args[i], 0, 16)
+			}
+			if err != nil {
+				fmt.Println("usage: mem [start [length]]")
+				continue
+			}
+			debugger.PrintMemory(dcpu, int(addr[0]), int(addr[1]))
+		case "save", "load":
+			if len(args) != 2 {
+				fmt.Printf("usage: %s file\n", args[0])
+				continue
+			}
+			if args[0] == "save" {
+				err = dcpu.SaveStateFile(args[1])
+			} else {
+				err = dcpu.LoadStateFile(args[1])
+			}
+			if err != nil {
+				fmt.Println(err)
+			}
 		case "r":   debugger.RDump(dcpu)
-		case "op":  debugger.PrintInstruction(dcpu)
+		case "op":  debugger.PrintSymbolicInstruction(dcpu, syms)
 		}
 	}
 }
 
 func runDisassembler() {
+	flags := flag.NewFlagSet("disassemble", flag.ExitOnError)
+	symbolsPath := flags.String("symbols", "", "read symbols from this symbol map")
+	format := flags.String("format", "", "format of the program: big, little, hex or ihex (default: detect)")
+	flags.Parse(os.Args[2:])
+	path := flags.Arg(0)
+	if path == "" {
+		printHelp("disassemble")
+		return
+	}
+
+	mem, err := readImage(path, *format)
+	assert(err)
+	syms, err := readSymbols(*symbolsPath)
+	assert(err)
+	assert(disassembler.Listing(os.Stdout, mem, syms))
+}
+
+// readSymbols reads the symbol map at path, if path is not empty.
+func readSymbols(path string) (symbols.Map, error) {
+	if path == "" {
+		return nil, nil
+	}
+	return symbols.ReadFile(path)
+}
+
+// defineFlag collects -D NAME=value flags into a map of constants.
+type defineFlag map[string]int
+
+func (f defineFlag) String() string {
+	return ""
+}
+
+func (f defineFlag) Set(s string) error {
+	name, value := s, "1"
+	if i := strings.Index(s, "="); i >= 0 {
+		name, value = s[:i], s[i+1:]
+	}
+	n, err := strconv.ParseInt(value, 0, 32)
+	if err != nil {
+		return err
+	}
+	f[name] = int(n)
+	return nil
+}
+
+// pathsFlag collects repeated flags into a list of paths.
+type pathsFlag []string
+
+func (f *pathsFlag) String() string {
+	return strings.Join(*f, string(os.PathListSeparator))
+}
+
+func (f *pathsFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
 }
 
 func runAssembler() {
-	flag.Parse()
-	srcPath := flag.Arg(1)
+	flags := flag.NewFlagSet("assemble", flag.ExitOnError)
+	noRelax := flags.Bool("norelax", false, "keep label operands as next words for a fixed layout")
+	compile := flags.Bool("c", false, "write a relocatable object for the linker")
+	reloc := flags.Bool("reloc", false, "write a program with relocations, which can be loaded at any address")
+	listing := flags.String("listing", "", "write a listing of the source with the generated code to this file")
+	symbolsPath := flags.String("symbols", "", "write the labels to this symbol map, as JSON if it ends in .json")
+	sourceMapPath := flags.String("sourcemap", "", "write the source line of each address to this file")
+	format := flags.String("format", "big", "format of the program: big, little, hex or ihex")
+	defines := defineFlag{}
+	flags.Var(defines, "D", "define a constant as NAME=value, or NAME for 1")
+	var includePaths pathsFlag
+	flags.Var(&includePaths, "I", "add a directory to search for included files")
+	flags.Parse(os.Args[2:])
+	srcPath := flags.Arg(0)
 	if srcPath == "" {
 		printHelp("assemble")
 		return
 	}
-	src, err := ioutil.ReadFile(srcPath)
+
+	f, err := words.ParseFormat(*format)
 	assert(err)
+	if (*compile || *reloc) && f != words.BigEndian {
+		assert(errors.New("-format cannot be used with -c or -reloc"))
+	}
 
 	var destWriter io.Writer
-	destPath := flag.Arg(2)
+	destPath := flags.Arg(1)
 	if destPath == "" {
 		destWriter = os.Stdout
 	} else {
-		destWriter, err = os.Open(destPath)
+		destWriter, err = os.Create(destPath)
 		assert(err)
 	}
 
-	gen, err := assembler.Assemble(src)
+	config := &assembler.Config{
+		Warnings: os.Stderr,
+		NoRelax: *noRelax,
+		Defines: defines,
+		IncludePaths: includePaths,
+	}
+	if *listing != "" {
+		file, err := os.Create(*listing)
+		assert(err)
+		defer file.Close()
+		config.Listing = file
+	}
+	var syms symbols.Map
+	if *symbolsPath != "" {
+		config.Symbols = &syms
+		defer func() {
+			file, err := os.Create(*symbolsPath)
+			assert(err)
+			if strings.HasSuffix(*symbolsPath, ".json") {
+				err = syms.WriteJSON(file)
+			} else {
+				err = syms.WriteText(file)
+			}
+			assert(err)
+			assert(file.Close())
+		}()
+	}
+	var lines sourcemap.Map
+	if *sourceMapPath != "" {
+		config.SourceMap = &lines
+		defer func() {
+			assert(lines.WriteFile(*sourceMapPath))
+		}()
+	}
+	if *compile {
+		obj, err := config.AssembleObjectFile(srcPath)
+		assert(err)
+		assert(obj.Write(destWriter))
+		return
+	}
+	if *reloc {
+		prog, err := config.AssembleRelocatableFile(srcPath)
+		assert(err)
+		assert(prog.Write(destWriter))
+		return
+	}
+	gen, err := config.AssembleFile(srcPath)
+	assert(err)
+	assert(words.Encode(destWriter, gen, f))
+}
+
+// parseArgs parses flags which may appear between the arguments,
+// and returns the arguments.
+func parseArgs(flags *flag.FlagSet, args []string) []string {
+	rest := make([]string, 0)
+	for {
+		flags.Parse(args)
+		if flags.NArg() == 0 {
+			return rest
+		}
+		rest = append(rest, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+}
+
+func runLinker() {
+	flags := flag.NewFlagSet("link", flag.ExitOnError)
+	destPath := flags.String("o", "", "write the program to this file instead of stdout")
+	paths := parseArgs(flags, os.Args[2:])
+	if len(paths) == 0 {
+		printHelp("link")
+		return
+	}
+
+	objs := make([]*object.File, 0, len(paths))
+	libs := make([]*object.Archive, 0)
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		assert(err)
+		if object.IsArchive(data) {
+			lib, err := object.ReadArchive(bytes.NewReader(data), path)
+			assert(err)
+			libs = append(libs, lib)
+			continue
+		}
+		obj, err := object.ReadFile(path)
+		assert(err)
+		objs = append(objs, obj)
+	}
+	gen, err := linker.LinkArchives(objs, libs)
 	assert(err)
-	genReader := words.NewReadWriter(gen)
-	_, err = io.Copy(destWriter, genReader)
+
+	var destWriter io.Writer = os.Stdout
+	if *destPath != "" {
+		file, err := os.Create(*destPath)
+		assert(err)
+		defer file.Close()
+		destWriter = file
+	}
+	_, err = io.Copy(destWriter, words.NewReadWriter(gen))
 	assert(err)
 }
 
+func runArchiver() {
+	flags := flag.NewFlagSet("ar", flag.ExitOnError)
+	list := flags.Bool("t", false, "list the members of the archive and the symbols they export")
+	flags.Parse(os.Args[2:])
+	path := flags.Arg(0)
+	if path == "" || (!*list && flags.NArg() < 2) {
+		printHelp("ar")
+		return
+	}
+
+	if *list {
+		lib, err := object.ReadArchiveFile(path)
+		assert(err)
+		for _, obj := range lib.Members {
+			fmt.Println(obj.Name)
+			for _, sym := range obj.Symbols {
+				fmt.Println("\t" + sym.Name)
+			}
+		}
+		return
+	}
+
+	objs := make([]*object.File, flags.NArg()-1)
+	for i, objPath := range flags.Args()[1:] {
+		obj, err := object.ReadFile(objPath)
+		assert(err)
+		objs[i] = obj
+	}
+	assert(object.NewArchive(objs).WriteFile(path))
+}
+
+// interrupted returns a channel which is closed on an interrupt (Ctrl-C),
+// to stop the emulation.
+func interrupted() <-chan bool {
+	stop := make(chan bool)
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		close(stop)
+	}()
+	return stop
+}
+
+func runProfiler() {
+	flags := flag.NewFlagSet("profile", flag.ExitOnError)
+	base := flags.String("base", "0", "load the program at this address")
+	format := flags.String("format", "", "format of the program: big, little, hex or ihex (default: detect)")
+	symbolsPath := flags.String("symbols", "", "read the labels from this symbol map")
+	cycles := flags.Uint64("cycles", 0, "stop after this many cycles (default: no limit)")
+	n := flags.Int("n", 20, "number of routines to show, or 0 for all")
+	addresses := flags.Bool("addresses", false, "also show the hottest addresses")
+	pprofPath := flags.String("pprof", "", "write the call stacks to this file for go tool pprof")
+	foldedPath := flags.String("folded", "", "write the call stacks to this file as folded stacks for flame graphs")
+	sourceMapPath := flags.String("sourcemap", "", "read the source lines for -pprof from this source map")
+	flags.Parse(os.Args[2:])
+	path := flags.Arg(0)
+	if path == "" {
+		printHelp("profile")
+		return
+	}
+
+	dcpu := emulator.NewDCPU()
+	assert(loadProgram(dcpu, path, *base, *format))
+	syms, err := readSymbols(*symbolsPath)
+	assert(err)
+	prof := profile.New()
+	dcpu.Tracer = prof
+	_, err = dcpu.RunCycles(interrupted(), *cycles)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+
+	assert(prof.WriteReport(os.Stdout, syms, *n))
+	if *addresses {
+		fmt.Println()
+		assert(prof.WriteAddresses(os.Stdout, syms, *n))
+	}
+	if *foldedPath != "" {
+		file, err := os.Create(*foldedPath)
+		assert(err)
+		assert(prof.WriteFolded(file, syms))
+		assert(file.Close())
+	}
+	if *pprofPath != "" {
+		var lines sourcemap.Map
+		if *sourceMapPath != "" {
+			lines, err = sourcemap.ReadFile(*sourceMapPath)
+			assert(err)
+		}
+		file, err := os.Create(*pprofPath)
+		assert(err)
+		assert(prof.WritePprof(file, syms, lines))
+		assert(file.Close())
+	}
+}
+
+func runCoverage() {
+	flags := flag.NewFlagSet("coverage", flag.ExitOnError)
+	format := flags.String("format", "", "format of the program: big, little, hex or ihex (default: detect)")
+	sourceMapPath := flags.String("sourcemap", "", "read the source lines from this source map")
+	cycles := flags.Uint64("cycles", 0, "stop after this many cycles (default: no limit)")
+	lcovPath := flags.String("lcov", "", "write the coverage to this file in the lcov format")
+	htmlPath := flags.String("html", "", "write the coverage to this file as an HTML page of the sources")
+	flags.Parse(os.Args[2:])
+	path := flags.Arg(0)
+	if path == "" || *sourceMapPath == "" {
+		printHelp("coverage")
+		return
+	}
+
+	lines, err := sourcemap.ReadFile(*sourceMapPath)
+	assert(err)
+	dcpu := emulator.NewDCPU()
+	assert(loadProgram(dcpu, path, "0", *format))
+	mem := make([]uint16, len(dcpu.RAM))
+	copy(mem, dcpu.RAM)
+	cov := coverage.New()
+	dcpu.Tracer = cov
+	_, err = dcpu.RunCycles(interrupted(), *cycles)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+
+	files := cov.Report(mem, lines)
+	assert(coverage.WriteSummary(os.Stdout, files))
+	if *lcovPath != "" {
+		file, err := os.Create(*lcovPath)
+		assert(err)
+		assert(coverage.WriteLcov(file, files))
+		assert(file.Close())
+	}
+	if *htmlPath != "" {
+		file, err := os.Create(*htmlPath)
+		assert(err)
+		assert(coverage.WriteHTML(file, files))
+		assert(file.Close())
+	}
+}
+
+func runTests() {
+	flags := flag.NewFlagSet("test", flag.ExitOnError)
+	cycles := flags.Uint64("cycles", 1000000, "fail tests that take more cycles, or 0 for no limit")
+	run := flags.String("run", "", "only run the tests whose names match this regular expression")
+	verbose := flags.Bool("v", false, "also list the passed tests")
+	flags.Parse(os.Args[2:])
+	if flags.NArg() == 0 {
+		printHelp("test")
+		return
+	}
+
+	config := &asmtest.Config{Cycles: *cycles}
+	if *run != "" {
+		re, err := regexp.Compile(*run)
+		assert(err)
+		config.Run = re
+	}
+	passed := true
+	for _, path := range flags.Args() {
+		results, err := config.RunFile(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			fmt.Printf("FAIL\t%s\t[build failed]\n", path)
+			passed = false
+			continue
+		}
+		ok, err := asmtest.Write(os.Stdout, path, results, *verbose)
+		assert(err)
+		passed = passed && ok
+	}
+	if !passed {
+		os.Exit(1)
+	}
+}
+
+func runTraceDiff() {
+	flags := flag.NewFlagSet("tracediff", flag.ExitOnError)
+	context := flags.Int("context", 5, "number of steps to show before the difference")
+	flags.Parse(os.Args[2:])
+	if flags.NArg() != 2 {
+		printHelp("tracediff")
+		return
+	}
+	if *context < 0 {
+		assert(errors.New("-context must not be negative"))
+	}
+
+	readers := make([]*trace.Reader, 2)
+	for i, path := range flags.Args() {
+		file, err := os.Open(path)
+		assert(err)
+		defer file.Close()
+		readers[i], err = trace.NewReader(file)
+		assert(err)
+	}
+	d, steps, err := trace.Diff(readers[0], readers[1], *context)
+	assert(err)
+	if d == nil {
+		fmt.Printf("traces are equal for all %d steps\n", steps)
+		return
+	}
+
+	fmt.Printf("traces differ in the %s at step %d\n", d.What, d.Step)
+	for i, s := range d.Context {
+		fmt.Printf(" %8d  %s\n", d.Step-len(d.Context)+i, trace.FormatStep(s))
+	}
+	for i, s := range []*emulator.TraceStep{d.A, d.B} {
+		line := "(end of trace)"
+		if s != nil {
+			line = trace.FormatStep(s)
+		}
+		fmt.Printf("%s%8d  %s\n", "-+"[i:i+1], d.Step, line)
+	}
+	os.Exit(1)
+}
+
 func runHexdump() {
-	flag.Parse()
-	srcPath := flag.Arg(1)
-	if srcPath == "" {
+	flags := flag.NewFlagSet("hexdump", flag.ExitOnError)
+	format := flags.String("format", "", "format of the file: big, little, hex or ihex (default: detect)")
+	start := flags.String("start", "0", "address of the first word")
+	length := flags.String("length", "0", "number of words to show (default: all)")
+	width := flags.Int("width", 8, "words per line")
+	chars := flags.String("chars", "none", "character column: none, ascii or packed")
+	all := flags.Bool("v", false, "show repeated lines instead of collapsing them into *")
+	diff := flags.Bool("diff", false, "show the words that differ between two files")
+	flags.Parse(os.Args[2:])
+	srcPath := flags.Arg(0)
+	if srcPath == "" || (*diff && flags.NArg() < 2) {
 		printHelp("hexdump")
 		return
 	}
-	src, err := ioutil.ReadFile(srcPath)
+
+	opts := words.DumpOptions{Width: *width, All: *all}
+	n, err := strconv.ParseUint(*start, 0, 16)
+	assert(err)
+	opts.Start = int(n)
+	n, err = strconv.ParseUint(*length, 0, 17)
+	assert(err)
+	opts.Length = int(n)
+	opts.Chars, err = words.ParseChars(*chars)
 	assert(err)
-	w := make([]uint16, len(src)/2)
-	words.CopyFromBytes(w, src)
-	words.Hexdump(w, os.Stdout)
+
+	w, err := readImage(srcPath, *format)
+	assert(err)
+	if *diff {
+		other, err := readImage(flags.Arg(1), *format)
+		assert(err)
+		assert(words.DumpDiff(os.Stdout, w, other, opts))
+		return
+	}
+	assert(words.Dump(os.Stdout, w, opts))
 }
 
 func printHelp(topic string) {
 	switch topic {
 	case "assemble":
-		fmt.Println(`Usage: dcpu assemble dasmfile [binfile]`)
+		fmt.Println(`Usage: dcpu assemble [-c | -reloc] [-norelax] [-D NAME[=value]]... [-I dir]...
+                     [-listing lstfile] [-symbols mapfile] [-sourcemap srcmapfile]
+                     [-format format] dasmfile [binfile]
+
+Label operands whose value fits into a short literal are encoded inline,
+which moves all following code. -norelax keeps every label operand as a
+next word, so that the layout does not depend on label values.
+
+-D defines a constant as if by .equ, which can select variants of the
+program with .if and .ifdef. The value defaults to 1.
+
+Files of .include and .incbin are searched relative to the including file
+first, then in the directories given by -I.
+
+-c writes a relocatable object instead of a program, which is combined
+with other objects by "dcpu link". Symbols listed by .global are exported,
+and symbols that are not defined are imported from other objects.
+
+-reloc writes a program together with a table of the words that hold an
+address, so that it can be loaded at any address, as with "dcpu emulate
+-base". Label operands are not relaxed, as with -c.
+
+-listing writes each source line with its address and the words it
+generated, followed by a table of all labels and constants with the lines
+where they are defined and used.
+
+-symbols writes the addresses of all labels to a symbol map for "dcpu debug"
+and "dcpu disassemble". The map is written as JSON, including the kind and
+size of each label, if the file name ends in .json, or as lines of
+"address name" otherwise.
+
+-sourcemap writes the source line of each range of generated words, for
+"dcpu profile" and "dcpu coverage". Words generated by a macro belong to
+its invocation.
+
+-format selects the encoding of the program: big or little for binary
+words of either byte order, hex for text with four hex digits per word, or
+ihex for Intel HEX records of the big-endian bytes. It defaults to big.`)
 	case "debug":
-		fmt.Println("Usage: dcpu debug binfile")
+		fmt.Println(`Usage: dcpu debug [-base address] [-symbols mapfile] [-format format] binfile
+       dcpu debug -load-state statefile [-symbols mapfile]
+
+With a symbol map written by "dcpu assemble -symbols", instructions are
+shown with the label they belong to and the names of the addresses
+they use.
+
+The format of the program is detected unless given by -format, as
+described in "dcpu help emulate".
+
+The command "save file" writes the state of the machine to a file, which
+"load file" restores, as do -load-state and "dcpu emulate -load-state".`)
+	case "disassemble":
+		fmt.Println(`Usage: dcpu disassemble [-symbols mapfile] [-format format] binfile
+
+With a symbol map written by "dcpu assemble -symbols", labels are shown
+and addresses are replaced by their names. Data labels are shown as DAT.
+The format of the program is detected unless given by -format.`)
 	case "emulate":
-		fmt.Println("Usage: dcpu emulate binfile")
+		fmt.Println(`Usage: dcpu emulate [-base address] [-format format] [-save-state-on-exit statefile]
+                    [-trace tracefile [-trace-format text|binary]] binfile
+       dcpu emulate -load-state statefile [options]
+
+The program is loaded at the base address, which defaults to 0, and
+started there. Programs assembled with -reloc are relocated to it.
+
+-format gives the encoding of the program as big, little, hex or ihex,
+as described in "dcpu help assemble". Without it, Intel HEX records and
+hex text of four-digit words are recognized, and other programs are read
+as big-endian binary.
+
+The emulation stops at an error, at an instruction that jumps to itself,
+which halts the program, or on an interrupt (Ctrl-C). -save-state-on-exit
+then saves the registers and the RAM to a file, from which -load-state
+resumes the emulation later.
+
+-trace writes every executed instruction with its address, the registers
+it changed and the words it wrote to the RAM, as lines of text or in a
+compact binary format, for "dcpu tracediff".`)
 	case "hexdump":
-		fmt.Println(`Usage: dcpu hexdump binfile`)
+		fmt.Println(`Usage: dcpu hexdump [-format format] [-start address] [-length words]
+                    [-width words] [-chars none|ascii|packed] [-v] binfile
+       dcpu hexdump -diff [options] binfile1 binfile2
+
+Hexdump shows the address of each line, its words and, with -chars, their
+characters: ascii shows the low byte of each word as the screen does, and
+packed shows two characters per word, high byte first. Lines which repeat
+the line before them are collapsed into a single "*", unless -v is given.
+
+-diff shows only the lines in which the files differ, first as in binfile1
+prefixed by "-", then as in binfile2 prefixed by "+", with the differing
+words in brackets.
+
+The format of the files is detected unless given by -format, as
+described in "dcpu help emulate".`)
+	case "link":
+		fmt.Println(`Usage: dcpu link objfile... [-o binfile]
+
+Link combines objects created by "dcpu assemble -c" into a program.
+Sections of the same name are placed together in the order they first
+appear, starting at address 0. Unresolved and duplicate symbols are
+reported.
+
+Archives created by "dcpu ar" may be given like objects. Only the members
+that define symbols which are referenced but not defined otherwise are
+linked, after all objects.`)
+	case "profile":
+		fmt.Println(`Usage: dcpu profile [-base address] [-format format] [-symbols mapfile]
+                   [-cycles limit] [-n count] [-addresses] [-folded file]
+                   [-pprof file [-sourcemap srcmapfile]] binfile
+
+Profile runs the program like "dcpu emulate" until it halts, fails, reaches
+the cycle limit or is interrupted (Ctrl-C), and reports the routines in
+which it spent the most cycles.
+
+Routines are the labels of the symbol map written by "dcpu assemble
+-symbols", where local labels count toward their global label, and the
+targets of JSR that have no label. For each routine the report shows its
+own cycles and, if it was called by JSR, the cycles from its calls to their
+returns by SET PC, POP, including the routines it called.
+
+-addresses also reports the hottest instructions by address.
+
+-folded writes the cycles of each call stack as folded stacks, which flame
+graph tools read. -pprof writes the call stacks in the profile format of
+"go tool pprof", with the source lines of a source map written by "dcpu
+assemble -sourcemap".`)
+	case "coverage":
+		fmt.Println(`Usage: dcpu coverage -sourcemap srcmapfile [-format format] [-cycles limit]
+                    [-lcov file] [-html file] binfile
+
+Coverage runs the program like "dcpu emulate" until it halts, fails, reaches
+the cycle limit or is interrupted (Ctrl-C), and reports which source lines
+and branches ran, using the source map written by "dcpu assemble
+-sourcemap". The program must be assembled for address 0.
+
+A line is covered if one of its instructions ran. Each IFE, IFN, IFG and
+IFB has two branches: running the next instruction and skipping it.
+
+A summary of each file is printed. -lcov writes the coverage in the lcov
+format, and -html writes a page with the source of each file, colored by
+its coverage.`)
+	case "test":
+		fmt.Println(`Usage: dcpu test [-cycles limit] [-run regexp] [-v] dasmfile...
+
+Test runs the tests written in each assembly file and the files it includes.
+A test is a routine whose label starts with "test_". Each test runs in a
+fresh emulator with the assembled file, starting at its label with an empty
+stack. It passes if it returns by SET PC, POP within the cycle limit, and
+the expectations in its comments hold:
+
+	:test_double
+		; expect A = 0x40, [result] = 1
+		SET A, 0x20
+		JSR double
+		SET PC, POP
+
+An expectation compares a register, or the word at an address in brackets,
+with a value. Addresses and values are numbers, or labels and constants with
+an optional offset like "buffer+2". The expectations of a test are the
+comments between its label and the next label in its file that is not local.
+
+A test fails if it halts anywhere else than by returning, so it can check
+conditions in code by jumping to a label like ":fail SET PC, fail".
+
+The results are printed like "go test": failed tests with the lines of their
+failures, and with -v passed tests too. The exit status is 1 if a test
+failed.`)
+	case "tracediff":
+		fmt.Println(`Usage: dcpu tracediff [-context steps] tracefile1 tracefile2
+
+Tracediff compares two traces written by "dcpu emulate -trace", in either
+format, and reports the first step in which the address of the instruction,
+the registers it changed or the words it wrote differ, or where one trace
+ends before the other. The equal steps before it are shown for context,
+followed by the differing step of tracefile1, marked by "-", and of
+tracefile2, marked by "+". The exit status is 1 if the traces differ.`)
+	case "ar":
+		fmt.Println(`Usage: dcpu ar archive objfile...
+       dcpu ar -t archive
+
+Ar bundles objects into an archive, which is a library for "dcpu link"
+with an index of the symbols the objects export. An existing archive is
+replaced. -t lists the members of an archive and their symbols.`)
 	default:
 		fmt.Println(`Dcpu16 is an assembler suite targeting the DCPU-16.
 
@@ -185,10 +912,16 @@ Usage:
 The commands and their shorthands are:
 
 	assemble    a      converts assembler to machine code
+	coverage    c      reports the source lines a program runs
 	debug       d      debug a program in the emulator
 	disassemble dis    converts machine code to assembler
 	emulate     e      execute a program in the emulator
 	hexdump     h      display a binary file in readable format
+	profile     p      reports where a program spends its cycles
+	test        t      runs the tests of assembly files
+	ar                 bundles object files into a library archive
+	link        l      combines object files into a program
+	tracediff          finds the first difference between two traces
 
 Use "dcpu help [command]" for more information about a command.`)
 	}
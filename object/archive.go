@@ -0,0 +1,171 @@
+package object
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// The encoding of an archive starts with an index of the exported symbols,
+// so that the objects defining them can be found quickly:
+//
+//	magic     "DCPA"
+//	version   uint16
+//	index     uint32 count, then for each: name, uint32 member
+//	members   uint32 count, then for each:
+//	          name, uint32 length, encoded object
+const archiveMagic = "DCPA"
+
+// Archive is a library of objects. The linker only uses the members
+// that define symbols which are referenced by other objects.
+type Archive struct {
+	Name    string // file the archive was read from, used in errors
+	Members []*File
+	Index   map[string]int // member which exports a symbol
+}
+
+// NewArchive bundles objects into an archive. The members are named by the
+// base name of their files. If several members export the same symbol, the
+// index refers to the first one.
+func NewArchive(members []*File) *Archive {
+	a := &Archive{Members: members, Index: make(map[string]int)}
+	for i := len(members) - 1; i >= 0; i-- {
+		for _, sym := range members[i].Symbols {
+			a.Index[sym.Name] = i
+		}
+	}
+	return a
+}
+
+// memberName returns the name under which an object is stored.
+func memberName(f *File) string {
+	if f.Name == "" {
+		return "<object>"
+	}
+	return filepath.Base(f.Name)
+}
+
+// IsArchive reports whether data starts like an encoded archive.
+func IsArchive(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(archiveMagic))
+}
+
+// Write encodes the archive into w.
+func (a *Archive) Write(w io.Writer) error {
+	e := &encoder{w: bufio.NewWriter(w)}
+	e.w.WriteString(archiveMagic)
+	e.put(uint16(version))
+
+	names := make([]string, 0, len(a.Index))
+	for name := range a.Index {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	e.put(uint32(len(names)))
+	for _, name := range names {
+		e.string(name)
+		e.put(uint32(a.Index[name]))
+	}
+
+	e.put(uint32(len(a.Members)))
+	for _, f := range a.Members {
+		var buf bytes.Buffer
+		if err := f.Write(&buf); err != nil {
+			return err
+		}
+		e.string(memberName(f))
+		e.put(uint32(buf.Len()))
+		if e.err == nil {
+			_, e.err = e.w.Write(buf.Bytes())
+		}
+	}
+	if e.err != nil {
+		return e.err
+	}
+	return e.w.Flush()
+}
+
+// WriteFile writes the archive into the named file.
+func (a *Archive) WriteFile(filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err = a.Write(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// ReadArchive decodes an archive from r. The members are named
+// "archive(member)" after the name of the archive.
+func ReadArchive(r io.Reader, name string) (*Archive, error) {
+	d := &decoder{r: bufio.NewReader(r)}
+	head := make([]byte, len(archiveMagic))
+	if _, err := io.ReadFull(d.r, head); err != nil || string(head) != archiveMagic {
+		return nil, errors.New("object: not an archive")
+	}
+	var v uint16
+	if d.get(&v); d.err == nil && v != version {
+		return nil, errors.New(fmt.Sprintf("object: unsupported version %d", v))
+	}
+
+	a := &Archive{Name: name, Index: make(map[string]int)}
+	var n uint32
+	d.get(&n)
+	for i := 0; i < int(n) && d.err == nil; i++ {
+		sym := d.string()
+		var member uint32
+		d.get(&member)
+		a.Index[sym] = int(member)
+	}
+	d.get(&n)
+	for i := 0; i < int(n) && d.err == nil; i++ {
+		member := d.string()
+		var size uint32
+		d.get(&size)
+		if d.err != nil {
+			break
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(d.r, int64(size)))
+		if err != nil || len(data) != int(size) {
+			return nil, errors.New("object: truncated archive")
+		}
+		f, err := Read(bytes.NewReader(data))
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("object: member %s: %s", member, err))
+		}
+		f.Name = name + "(" + member + ")"
+		a.Members = append(a.Members, f)
+	}
+	if d.err != nil {
+		return nil, errors.New("object: truncated archive")
+	}
+	for sym, i := range a.Index {
+		if i >= len(a.Members) {
+			return nil, errors.New("object: invalid index entry for symbol " + sym)
+		}
+	}
+	return a, nil
+}
+
+// ReadArchiveFile reads the archive from the named file.
+func ReadArchiveFile(filename string) (*Archive, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	a, err := ReadArchive(file, filename)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%s: %s", filename, err))
+	}
+	return a, nil
+}
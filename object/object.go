@@ -0,0 +1,261 @@
+// Package object implements relocatable object files, which the assembler
+// generates from a single source file and the linker combines into a program.
+//
+// An object consists of sections of machine code, which are placed at
+// their final address by the linker. Words that hold an address are listed
+// as relocations, and the linker adds the address of a section or of a symbol
+// exported by another object to them.
+//
+// The encoding is big-endian like the words of a program:
+//
+//	magic     "DCPO"
+//	version   uint16
+//	sections  uint16 count, then for each:
+//	          name, uint16 align, uint32 length, words,
+//	          uint32 relocation count, then for each:
+//	          uint16 offset, int16 section, symbol name
+//	symbols   uint32 count, then for each:
+//	          name, int16 section, uint16 value
+//
+// Names are stored as an uint16 length followed by the bytes.
+package object
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	magic   = "DCPO"
+	version = 1
+)
+
+// File is a relocatable object.
+type File struct {
+	Name     string // file the object was read from, used in errors
+	Sections []*Section
+	Symbols  []Symbol // exported symbols
+}
+
+// Section is a block of machine code that is placed as a whole.
+type Section struct {
+	Name   string
+	Align  int // the address of the section is a multiple of Align
+	Data   []uint16
+	Relocs []Reloc
+}
+
+// Symbol is a name exported to other objects.
+type Symbol struct {
+	Name    string
+	Section int    // index of the section, or -1 for an absolute value
+	Value   uint16 // offset in the section or absolute value
+}
+
+// Reloc marks a word which depends on the address of a section or
+// of an imported symbol. The address is added to the word.
+type Reloc struct {
+	Offset  uint16 // offset of the word in the section
+	Section int    // index of the section, or -1 for a symbol
+	Symbol  string // name of the imported symbol if Section is -1
+}
+
+// Imports returns the names of all symbols the object references,
+// in the order they first appear.
+func (f *File) Imports() []string {
+	names := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, s := range f.Sections {
+		for _, r := range s.Relocs {
+			if r.Section < 0 && !seen[r.Symbol] {
+				seen[r.Symbol] = true
+				names = append(names, r.Symbol)
+			}
+		}
+	}
+	return names
+}
+
+// Write encodes the object into w.
+func (f *File) Write(w io.Writer) error {
+	for _, s := range f.Sections {
+		if s.Align < 1 || s.Align > 0xffff {
+			return errors.New(fmt.Sprintf("object: invalid alignment %#x of section %s", s.Align, s.Name))
+		}
+	}
+	e := &encoder{w: bufio.NewWriter(w)}
+	e.w.WriteString(magic)
+	e.put(uint16(version))
+	e.put(uint16(len(f.Sections)))
+	for _, s := range f.Sections {
+		e.string(s.Name)
+		e.put(uint16(s.Align))
+		e.put(uint32(len(s.Data)))
+		e.put(s.Data)
+		e.put(uint32(len(s.Relocs)))
+		for _, r := range s.Relocs {
+			e.put(r.Offset)
+			e.put(int16(r.Section))
+			e.string(r.Symbol)
+		}
+	}
+	e.put(uint32(len(f.Symbols)))
+	for _, sym := range f.Symbols {
+		e.string(sym.Name)
+		e.put(int16(sym.Section))
+		e.put(sym.Value)
+	}
+	if e.err != nil {
+		return e.err
+	}
+	return e.w.Flush()
+}
+
+// WriteFile writes the object into the named file.
+func (f *File) WriteFile(filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err = f.Write(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Read decodes an object from r.
+func Read(r io.Reader) (f *File, err error) {
+	d := &decoder{r: bufio.NewReader(r)}
+	head := make([]byte, len(magic))
+	if _, err := io.ReadFull(d.r, head); err != nil || string(head) != magic {
+		return nil, errors.New("object: not an object file")
+	}
+	var v uint16
+	if d.get(&v); d.err == nil && v != version {
+		return nil, errors.New(fmt.Sprintf("object: unsupported version %d", v))
+	}
+
+	f = &File{}
+	var nsect uint16
+	d.get(&nsect)
+	for i := 0; i < int(nsect) && d.err == nil; i++ {
+		s := &Section{Name: d.string()}
+		var align uint16
+		var n uint32
+		d.get(&align)
+		d.get(&n)
+		if n > 0x10000 {
+			return nil, errors.New("object: section exceeds the address space")
+		}
+		s.Align = int(align)
+		s.Data = make([]uint16, n)
+		d.get(s.Data)
+		d.get(&n)
+		for j := 0; j < int(n) && d.err == nil; j++ {
+			var r Reloc
+			var sect int16
+			d.get(&r.Offset)
+			d.get(&sect)
+			r.Section, r.Symbol = int(sect), d.string()
+			s.Relocs = append(s.Relocs, r)
+		}
+		f.Sections = append(f.Sections, s)
+	}
+	var nsym uint32
+	d.get(&nsym)
+	for i := 0; i < int(nsym) && d.err == nil; i++ {
+		sym := Symbol{Name: d.string()}
+		var sect int16
+		d.get(&sect)
+		d.get(&sym.Value)
+		sym.Section = int(sect)
+		f.Symbols = append(f.Symbols, sym)
+	}
+	if d.err != nil {
+		return nil, errors.New("object: truncated object file")
+	}
+	if err := f.check(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// ReadFile reads the object from the named file.
+func ReadFile(filename string) (*File, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	f, err := Read(file)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%s: %s", filename, err))
+	}
+	f.Name = filename
+	return f, nil
+}
+
+// check ensures that all indexes and offsets of the object are valid.
+func (f *File) check() error {
+	valid := func(i int) bool { return i >= -1 && i < len(f.Sections) }
+	for _, s := range f.Sections {
+		for _, r := range s.Relocs {
+			if int(r.Offset) >= len(s.Data) || !valid(r.Section) {
+				return errors.New("object: invalid relocation in section " + s.Name)
+			}
+		}
+	}
+	for _, sym := range f.Symbols {
+		if !valid(sym.Section) {
+			return errors.New("object: invalid section of symbol " + sym.Name)
+		}
+	}
+	return nil
+}
+
+// encoder writes big-endian values and remembers the first error.
+type encoder struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (e *encoder) put(v interface{}) {
+	if e.err == nil {
+		e.err = binary.Write(e.w, binary.BigEndian, v)
+	}
+}
+
+func (e *encoder) string(s string) {
+	e.put(uint16(len(s)))
+	if e.err == nil {
+		_, e.err = e.w.WriteString(s)
+	}
+}
+
+// decoder reads big-endian values and remembers the first error.
+type decoder struct {
+	r   *bufio.Reader
+	err error
+}
+
+func (d *decoder) get(v interface{}) {
+	if d.err == nil {
+		d.err = binary.Read(d.r, binary.BigEndian, v)
+	}
+}
+
+func (d *decoder) string() string {
+	var n uint16
+	d.get(&n)
+	if d.err != nil {
+		return ""
+	}
+	b := make([]byte, n)
+	_, d.err = io.ReadFull(d.r, b)
+	return string(b)
+}
@@ -0,0 +1,87 @@
+package object
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestReadWrite(t *testing.T) {
+	f := &File{
+		Sections: []*Section{
+			{"text", 1, []uint16{0x7c10, 0x0000, 0x7dc1, 0x0002}, []Reloc{{1, -1, "print"}, {3, 0, ""}}},
+			{"data", 4, []uint16{1, 2, 3}, nil},
+		},
+		Symbols: []Symbol{{"start", 0, 0}, {"size", -1, 3}},
+	}
+	var buf bytes.Buffer
+	if err := f.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	g, err := Read(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(f, g) {
+		t.Errorf("expected %+v, got %+v", f, g)
+	}
+	if imports := g.Imports(); len(imports) != 1 || imports[0] != "print" {
+		t.Errorf("expected imports [print], got %v", imports)
+	}
+
+	f.Sections[1].Align = 0x10000
+	if err := f.Write(&buf); err == nil {
+		t.Errorf("expected an error for an alignment that does not fit into a word")
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	var buf bytes.Buffer
+	f := &File{Sections: []*Section{{"text", 1, []uint16{1}, []Reloc{{1, 0, ""}}}}}
+	f.Write(&buf)
+	valid := buf.Bytes()
+
+	for _, c := range []struct {
+		src []byte
+		msg string
+	}{
+		{[]byte("MZ\x90\x00"), "object: not an object file"},
+		{valid[:len(valid)-3], "object: truncated object file"},
+		{valid, "object: invalid relocation in section text"},
+	} {
+		_, err := Read(bytes.NewReader(c.src))
+		if err == nil || err.Error() != c.msg {
+			t.Errorf("expected error %q, got %v", c.msg, err)
+		}
+	}
+}
+
+func TestArchive(t *testing.T) {
+	a := NewArchive([]*File{
+		{Name: "out/print.o", Sections: []*Section{{"text", 1, []uint16{0x61c1}, nil}},
+			Symbols: []Symbol{{"print", 0, 0}}},
+		{Name: "out/math.o", Sections: []*Section{{"text", 1, []uint16{0x61c1, 0x61c1}, nil}},
+			Symbols: []Symbol{{"mul", 0, 0}, {"print", 0, 1}}},
+	})
+	if a.Index["print"] != 0 || a.Index["mul"] != 1 {
+		t.Errorf("unexpected index %v", a.Index)
+	}
+
+	var buf bytes.Buffer
+	if err := a.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !IsArchive(buf.Bytes()) {
+		t.Errorf("written archive is not recognized")
+	}
+	b, err := ReadArchive(&buf, "lib.a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(a.Index, b.Index) || len(b.Members) != 2 {
+		t.Fatalf("expected index %v and 2 members, got %v and %d", a.Index, b.Index, len(b.Members))
+	}
+	if b.Members[1].Name != "lib.a(math.o)" || !reflect.DeepEqual(b.Members[1].Sections, a.Members[1].Sections) {
+		t.Errorf("member differs: %+v", b.Members[1])
+	}
+}
@@ -0,0 +1,164 @@
+package profile
+
+import (
+	"github.com/xconstruct/dcpu16/sourcemap"
+	"github.com/xconstruct/dcpu16/symbols"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// WriteFolded writes the samples as folded stacks, which flame graph tools
+// read: one line per call stack with the names of its routines from the
+// outermost one, separated by ';', and its cycles.
+func (p *Profile) WriteFolded(w io.Writer, syms symbols.Map) error {
+	labels := p.labels(syms)
+	cycles := make(map[string]uint64)
+	for _, s := range p.Samples() {
+		names := make([]string, len(s.Stack))
+		for i, addr := range s.Stack {
+			names[i] = routine(labels, addr).Name
+		}
+		cycles[strings.Join(names, ";")] += s.Cycles
+	}
+	stacks := make([]string, 0, len(cycles))
+	for stack := range cycles {
+		stacks = append(stacks, stack)
+	}
+	sort.Strings(stacks)
+
+	bw := bufio.NewWriter(w)
+	for _, stack := range stacks {
+		fmt.Fprintf(bw, "%s %d\n", stack, cycles[stack])
+	}
+	return bw.Flush()
+}
+
+// WritePprof writes the samples as a gzipped profile.proto message, which
+// "go tool pprof" reads. Each sample has the values "instructions/count"
+// and "cycles/count". The functions are the routines of the program, and
+// their lines are taken from the source map, if it is not nil.
+func (p *Profile) WritePprof(w io.Writer, syms symbols.Map, lines sourcemap.Map) error {
+	labels := p.labels(syms)
+	var msg protobuf
+	strs := map[string]int{"": 0}
+	table := []string{""}
+	str := func(s string) int64 {
+		if i, ok := strs[s]; ok {
+			return int64(i)
+		}
+		strs[s] = len(table)
+		table = append(table, s)
+		return int64(len(table) - 1)
+	}
+
+	// sample_type
+	for _, typ := range []string{"instructions", "cycles"} {
+		var vt protobuf
+		vt.varint(1, str(typ))
+		vt.varint(2, str("count"))
+		msg.bytes(1, vt)
+	}
+
+	// samples, with locations and functions as they appear
+	locations := make(map[uint16]int64)
+	functions := make(map[string]int64)
+	var locs, funcs protobuf
+	location := func(addr uint16) int64 {
+		if id, ok := locations[addr]; ok {
+			return id
+		}
+		sym := routine(labels, addr)
+		fn, ok := functions[sym.Name]
+		if !ok {
+			fn = int64(len(functions) + 1)
+			functions[sym.Name] = fn
+			var f protobuf
+			f.varint(1, fn)
+			f.varint(2, str(sym.Name))
+			f.varint(3, str(sym.Name))
+			if l, ok := lines.Lookup(sym.Addr); ok && sym.Name != "?" {
+				f.varint(4, str(l.File))
+				f.varint(5, int64(l.Line))
+			}
+			funcs.bytes(5, f)
+		}
+
+		id := int64(len(locations) + 1)
+		locations[addr] = id
+		var line, loc protobuf
+		line.varint(1, fn)
+		if l, ok := lines.Lookup(addr); ok {
+			line.varint(2, int64(l.Line))
+		}
+		loc.varint(1, id)
+		loc.varint(3, int64(addr))
+		loc.bytes(4, line)
+		locs.bytes(4, loc)
+		return id
+	}
+	for _, s := range p.Samples() {
+		ids := make([]int64, len(s.Stack))
+		for i, addr := range s.Stack {
+			// pprof lists the innermost location first
+			ids[len(ids)-1-i] = location(addr)
+		}
+		var sample protobuf
+		sample.packed(1, ids)
+		sample.packed(2, []int64{int64(s.Steps), int64(s.Cycles)})
+		msg.bytes(2, sample)
+	}
+	msg = append(msg, locs...)
+	msg = append(msg, funcs...)
+
+	var period protobuf
+	period.varint(1, str("cycles"))
+	period.varint(2, str("count"))
+	for _, s := range table {
+		msg.bytes(6, []byte(s))
+	}
+	msg.bytes(11, period)
+	msg.varint(12, 1)
+
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(msg); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// protobuf is an encoded protocol buffer message.
+type protobuf []byte
+
+func (b *protobuf) uvarint(v uint64) {
+	for v >= 0x80 {
+		*b = append(*b, byte(v)|0x80)
+		v >>= 7
+	}
+	*b = append(*b, byte(v))
+}
+
+// varint appends a varint field.
+func (b *protobuf) varint(field int, v int64) {
+	b.uvarint(uint64(field) << 3)
+	b.uvarint(uint64(v))
+}
+
+// bytes appends a length-delimited field.
+func (b *protobuf) bytes(field int, data []byte) {
+	b.uvarint(uint64(field)<<3 | 2)
+	b.uvarint(uint64(len(data)))
+	*b = append(*b, data...)
+}
+
+// packed appends a packed repeated varint field.
+func (b *protobuf) packed(field int, vs []int64) {
+	var data protobuf
+	for _, v := range vs {
+		data.uvarint(uint64(v))
+	}
+	b.bytes(field, data)
+}
@@ -0,0 +1,311 @@
+// Package profile measures where a DCPU program spends its time.
+//
+// A Profile is an emulator.Tracer which counts the executions and cycles of
+// each address. It follows calls by JSR and returns by SET PC, POP, so that
+// the cycles of a routine can be reported including the routines it calls.
+package profile
+
+import (
+	"github.com/xconstruct/dcpu16/emulator"
+	"github.com/xconstruct/dcpu16/symbols"
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Word of the instruction SET PC, POP, which returns from a routine.
+const returnWord = 0x61c1
+
+// Profile records the execution of a program.
+type Profile struct {
+	Execs  []uint64 // executions of the instruction at each address
+	Cycles []uint64 // cycles taken by the instruction at each address
+	Total  uint64   // cycles of all instructions
+	Steps  uint64   // number of executed instructions
+
+	Calls     map[uint16]uint64 // calls of each routine, by address
+	Inclusive map[uint16]uint64 // cycles of the returned calls of each routine
+
+	stack   []frame
+	active  map[uint16]int // frames of each routine on the stack
+	samples map[string]*Sample
+	key     []byte
+}
+
+// frame is a call of a routine which has not returned yet.
+type frame struct {
+	addr  uint16 // address of the routine
+	call  uint16 // address of the JSR
+	ret   uint16 // address the call returns to
+	start uint64 // Total when the routine was called
+}
+
+// Sample is a call stack together with the instructions executed in it.
+type Sample struct {
+	Stack  []uint16 // addresses of the calls, outermost first, then of the instruction
+	Steps  uint64
+	Cycles uint64
+}
+
+// New returns an empty profile.
+func New() *Profile {
+	return &Profile{
+		Execs:     make([]uint64, 0x10000),
+		Cycles:    make([]uint64, 0x10000),
+		Calls:     make(map[uint16]uint64),
+		Inclusive: make(map[uint16]uint64),
+		active:    make(map[uint16]int),
+		samples:   make(map[string]*Sample),
+	}
+}
+
+// Trace records an executed instruction.
+func (p *Profile) Trace(s *emulator.TraceStep) {
+	p.Execs[s.PC]++
+	p.Cycles[s.PC] += uint64(s.Cycles)
+	p.Total += uint64(s.Cycles)
+	p.Steps++
+	p.sample(s)
+
+	_, op, _ := emulator.GetOp(s.Words[0])
+	switch {
+	case s.Words[0]&0xf == 0 && op == 0x01: // JSR
+		target := newPC(s)
+		p.Calls[target]++
+		p.active[target]++
+		// the cycles of the JSR itself belong to the caller
+		p.stack = append(p.stack, frame{target, s.PC, s.PC + uint16(len(s.Words)), p.Total})
+	case s.Words[0] == returnWord:
+		// pop the frames up to the one returning to the new PC, which
+		// skips routines that left the stack through other means
+		pc := newPC(s)
+		for i := len(p.stack) - 1; i >= 0; i-- {
+			if p.stack[i].ret == pc {
+				for len(p.stack) > i {
+					p.pop()
+				}
+				break
+			}
+		}
+	}
+}
+
+// sample adds an instruction to the sample of the current call stack.
+func (p *Profile) sample(s *emulator.TraceStep) {
+	p.key = p.key[:0]
+	for _, f := range p.stack {
+		p.key = append(p.key, byte(f.call>>8), byte(f.call))
+	}
+	p.key = append(p.key, byte(s.PC>>8), byte(s.PC))
+	sample := p.samples[string(p.key)]
+	if sample == nil {
+		stack := make([]uint16, 0, len(p.stack)+1)
+		for _, f := range p.stack {
+			stack = append(stack, f.call)
+		}
+		sample = &Sample{Stack: append(stack, s.PC)}
+		p.samples[string(p.key)] = sample
+	}
+	sample.Steps++
+	sample.Cycles += uint64(s.Cycles)
+}
+
+// Samples returns the call stacks in which instructions were executed,
+// sorted by their addresses.
+func (p *Profile) Samples() []*Sample {
+	keys := make([]string, 0, len(p.samples))
+	for key := range p.samples {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	samples := make([]*Sample, len(keys))
+	for i, key := range keys {
+		samples[i] = p.samples[key]
+	}
+	return samples
+}
+
+// newPC returns the address of the instruction executed after s.
+func newPC(s *emulator.TraceStep) uint16 {
+	for _, r := range s.Regs {
+		if r.Reg == emulator.RegPC {
+			return r.Value
+		}
+	}
+	return s.PC + uint16(len(s.Words))
+}
+
+func (p *Profile) pop() {
+	f := p.stack[len(p.stack)-1]
+	p.stack = p.stack[:len(p.stack)-1]
+	// recursive calls are already counted by the outermost one
+	if p.active[f.addr]--; p.active[f.addr] == 0 {
+		p.Inclusive[f.addr] += p.Total - f.start
+	}
+}
+
+// Stack returns the addresses of the routines being called, outermost first.
+func (p *Profile) Stack() []uint16 {
+	stack := make([]uint16, len(p.stack))
+	for i, f := range p.stack {
+		stack[i] = f.addr
+	}
+	return stack
+}
+
+// inclusive returns the cycles of all calls of the routine at addr,
+// including the calls that have not returned yet.
+func (p *Profile) inclusive(addr uint16) uint64 {
+	n := p.Inclusive[addr]
+	for _, f := range p.stack {
+		if f.addr == addr {
+			return n + p.Total - f.start
+		}
+	}
+	return n
+}
+
+// Routine is the part of a program from a label up to the next one.
+type Routine struct {
+	Name      string
+	Addr      uint16
+	Execs     uint64 // executed instructions of the routine itself
+	Cycles    uint64 // cycles of the routine itself
+	Calls     uint64 // calls by JSR
+	Inclusive uint64 // cycles of the calls including called routines
+}
+
+// Routines aggregates the profile by the labels of syms. Local labels,
+// whose names contain a '.', and labels local to macro expansions, whose
+// names contain a '@', count toward the label before them. Routines
+// that were called without a label are named "sub_" and their address,
+// and instructions before the first label belong to "?". Only executed
+// routines are returned, sorted by their own cycles.
+func (p *Profile) Routines(syms symbols.Map) []*Routine {
+	labels := p.labels(syms)
+	byName := make(map[string]*Routine)
+	routines := make([]*Routine, 0)
+	for addr, n := range p.Execs {
+		if n == 0 {
+			continue
+		}
+		sym := routine(labels, uint16(addr))
+		r := byName[sym.Name]
+		if r == nil {
+			r = &Routine{Name: sym.Name, Addr: sym.Addr}
+			if sym.Name != "?" {
+				r.Calls, r.Inclusive = p.Calls[sym.Addr], p.inclusive(sym.Addr)
+			}
+			byName[sym.Name] = r
+			routines = append(routines, r)
+		}
+		r.Execs += n
+		r.Cycles += p.Cycles[addr]
+	}
+	sort.Sort(byCycles(routines))
+	return routines
+}
+
+// labels returns the labels of the routines of the program: the global
+// labels of syms, and the targets of JSR without a label.
+func (p *Profile) labels(syms symbols.Map) symbols.Map {
+	labels := make(symbols.Map, 0, len(syms)+len(p.Calls))
+	for _, sym := range syms {
+		if !strings.ContainsAny(sym.Name, ".@") {
+			labels = append(labels, sym)
+		}
+	}
+	named := labels
+	for addr := range p.Calls {
+		if _, ok := named.Lookup(addr); !ok {
+			labels = append(labels, symbols.Symbol{Name: fmt.Sprintf("sub_%04x", addr), Addr: addr})
+		}
+	}
+	sort.Sort(labels)
+	return labels
+}
+
+// routine returns the label of the routine containing addr, which is
+// named "?" if it lies before all labels.
+func routine(labels symbols.Map, addr uint16) symbols.Symbol {
+	if sym, _, ok := labels.Find(addr); ok {
+		return sym
+	}
+	return symbols.Symbol{Name: "?"}
+}
+
+type byCycles []*Routine
+
+func (r byCycles) Len() int { return len(r) }
+func (r byCycles) Less(i, j int) bool {
+	return r[i].Cycles > r[j].Cycles || r[i].Cycles == r[j].Cycles && r[i].Addr < r[j].Addr
+}
+func (r byCycles) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+
+// WriteReport writes the n hottest routines, or all if n is 0, with their
+// own cycles and, for routines called by JSR, the cycles of their calls.
+func (p *Profile) WriteReport(w io.Writer, syms symbols.Map, n int) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "%d cycles in %d instructions\n\n", p.Total, p.Steps)
+	fmt.Fprintf(bw, "%10s %6s %10s %6s %8s %10s  %s\n", "cycles", "%", "inclusive", "%", "calls", "execs", "routine")
+	for i, r := range p.Routines(syms) {
+		if n > 0 && i >= n {
+			break
+		}
+		incl, inclPercent := "-", "-"
+		if r.Calls > 0 {
+			incl, inclPercent = fmt.Sprint(r.Inclusive), percent(r.Inclusive, p.Total)
+		}
+		fmt.Fprintf(bw, "%10d %6s %10s %6s %8d %10d  %s\n", r.Cycles, percent(r.Cycles, p.Total),
+			incl, inclPercent, r.Calls, r.Execs, r.Name)
+	}
+	return bw.Flush()
+}
+
+// WriteAddresses writes the n addresses, or all if n is 0, at which
+// the most cycles were spent, with their symbolic names.
+func (p *Profile) WriteAddresses(w io.Writer, syms symbols.Map, n int) error {
+	addrs := make([]int, 0)
+	for addr, c := range p.Execs {
+		if c > 0 {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Sort(byAddrCycles{addrs, p.Cycles})
+	if n > 0 && n < len(addrs) {
+		addrs = addrs[:n]
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "%10s %6s %10s  %s\n", "cycles", "%", "execs", "address")
+	for _, addr := range addrs {
+		name := fmt.Sprintf("%04x", addr)
+		if sym := syms.Name(uint16(addr)); sym != "" {
+			name += " " + sym
+		}
+		fmt.Fprintf(bw, "%10d %6s %10d  %s\n", p.Cycles[addr], percent(p.Cycles[addr], p.Total),
+			p.Execs[addr], name)
+	}
+	return bw.Flush()
+}
+
+type byAddrCycles struct {
+	addrs  []int
+	cycles []uint64
+}
+
+func (a byAddrCycles) Len() int { return len(a.addrs) }
+func (a byAddrCycles) Less(i, j int) bool {
+	ci, cj := a.cycles[a.addrs[i]], a.cycles[a.addrs[j]]
+	return ci > cj || ci == cj && a.addrs[i] < a.addrs[j]
+}
+func (a byAddrCycles) Swap(i, j int) { a.addrs[i], a.addrs[j] = a.addrs[j], a.addrs[i] }
+
+func percent(n, total uint64) string {
+	if total == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", 100*float64(n)/float64(total))
+}
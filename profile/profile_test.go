@@ -0,0 +1,197 @@
+package profile
+
+import (
+	"github.com/xconstruct/dcpu16/assembler"
+	"github.com/xconstruct/dcpu16/emulator"
+	"github.com/xconstruct/dcpu16/sourcemap"
+	"github.com/xconstruct/dcpu16/symbols"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const src = `
+:start	SET I, 0
+:.loop	JSR work
+	ADD I, 1
+	IFG 10, I
+		SET PC, .loop
+:halt	SET PC, halt
+:work	SET A, 0
+	JSR inner
+	JSR inner
+	SET PC, POP
+:inner	MUL A, 3
+	ADD A, 1
+	SET PC, POP
+`
+
+func run(t *testing.T) (*Profile, symbols.Map) {
+	var syms symbols.Map
+	gen, err := (&assembler.Config{Symbols: &syms}).Assemble([]byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dcpu := emulator.NewDCPU()
+	dcpu.Load(gen)
+	p := New()
+	dcpu.Tracer = p
+	if halted, err := dcpu.Run(nil); !halted || err != nil {
+		t.Fatalf("expected the program to halt, got %v, %v", halted, err)
+	}
+	return p, syms
+}
+
+func TestRoutines(t *testing.T) {
+	p, syms := run(t)
+	if p.Total != 232 || p.Steps != 141 {
+		t.Errorf("expected 232 cycles in 141 steps, got %d in %d", p.Total, p.Steps)
+	}
+	exp := []Routine{
+		{"inner", 0x000a, 60, 100, 20, 100},
+		{"start", 0x0000, 40, 71, 0, 0},
+		{"work", 0x0006, 40, 60, 10, 160},
+		{"halt", 0x0005, 1, 1, 0, 0},
+	}
+	got := p.Routines(syms)
+	if len(got) != len(exp) {
+		t.Fatalf("expected %d routines, got %d", len(exp), len(got))
+	}
+	for i, r := range got {
+		if *r != exp[i] {
+			t.Errorf("expected %+v, got %+v", exp[i], *r)
+		}
+	}
+
+	// without symbols, called routines are named by their address
+	got = p.Routines(nil)
+	if len(got) != 3 || got[0].Name != "sub_000a" || got[1].Name != "?" || got[2].Name != "sub_0006" {
+		t.Errorf("unexpected routines without symbols: %v", got)
+	}
+}
+
+func TestReport(t *testing.T) {
+	p, syms := run(t)
+	var buf bytes.Buffer
+	p.WriteReport(&buf, syms, 2)
+	exp := `232 cycles in 141 instructions
+
+    cycles      %  inclusive      %    calls      execs  routine
+       100  43.1%        100  43.1%       20         60  inner
+        71  30.6%          -      -        0         40  start
+`
+	if buf.String() != exp {
+		t.Errorf("expected\n%s\ngot\n%s", exp, buf.String())
+	}
+
+	buf.Reset()
+	p.WriteAddresses(&buf, syms, 1)
+	if lines := strings.Split(buf.String(), "\n"); lines[1] != "        40  17.2%         20  000a inner" {
+		t.Errorf("unexpected hottest address %q", lines[1])
+	}
+}
+
+func TestRecursion(t *testing.T) {
+	gen, err := assembler.Assemble([]byte(`
+	SET A, 3
+	JSR count
+:halt	SET PC, halt
+:count	IFE A, 0
+		SET PC, POP
+	SUB A, 1
+	JSR count
+	SET PC, POP
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dcpu := emulator.NewDCPU()
+	dcpu.Load(gen)
+	p := New()
+	dcpu.Tracer = p
+	dcpu.Run(nil)
+	// the outermost call takes all cycles but those of the first SET,
+	// the JSR and the halt
+	if n, exp := p.Inclusive[0x0003], p.Total-1-2-1; p.Calls[0x0003] != 4 || n != exp {
+		t.Errorf("expected 4 calls of %d cycles, got %d of %d", exp, p.Calls[0x0003], n)
+	}
+	if len(p.Stack()) != 0 {
+		t.Errorf("expected all calls to return, got %v", p.Stack())
+	}
+}
+
+func TestMacroLabels(t *testing.T) {
+	var syms symbols.Map
+	gen, err := (&assembler.Config{Symbols: &syms}).Assemble([]byte(`
+.macro countdown reg, from
+	SET reg, from
+:again	SUB reg, 1
+	IFN reg, 0
+		SET PC, again
+.endm
+	JSR work
+:halt	SET PC, halt
+:work	countdown I, 3
+	SET PC, POP
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dcpu := emulator.NewDCPU()
+	dcpu.Load(gen)
+	p := New()
+	dcpu.Tracer = p
+	dcpu.Run(nil)
+	var names []string
+	for _, r := range p.Routines(syms) {
+		names = append(names, r.Name)
+	}
+	if exp := []string{"work", "?", "halt"}; !reflect.DeepEqual(names, exp) {
+		t.Errorf("expected routines %v, got %v", exp, names)
+	}
+	var buf bytes.Buffer
+	p.WriteFolded(&buf, syms)
+	if strings.Contains(buf.String(), "@") {
+		t.Errorf("expected no macro labels in the stacks, got %q", buf.String())
+	}
+}
+
+func TestFolded(t *testing.T) {
+	p, syms := run(t)
+	var buf bytes.Buffer
+	p.WriteFolded(&buf, syms)
+	exp := "halt 1\nstart 71\nstart;work 60\nstart;work;inner 100\n"
+	if buf.String() != exp {
+		t.Errorf("expected %q, got %q", exp, buf.String())
+	}
+}
+
+func TestPprof(t *testing.T) {
+	p, syms := run(t)
+	var buf bytes.Buffer
+	lines := sourcemap.Map{{Addr: 0x000a, Size: 3, File: "inner.dasm", Line: 3}}
+	if err := p.WritePprof(&buf, syms, lines); err != nil {
+		t.Fatal(err)
+	}
+	r, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first sample type is instructions/count, with the strings
+	// numbered as they appear
+	if !bytes.HasPrefix(msg, []byte{0x0a, 0x04, 0x08, 0x01, 0x10, 0x02}) {
+		t.Errorf("unexpected start of the profile % x", msg[:6])
+	}
+	for _, s := range []string{"instructions", "cycles", "start", "work", "inner", "inner.dasm"} {
+		if !bytes.Contains(msg, append([]byte{0x32, byte(len(s))}, s...)) {
+			t.Errorf("string %q is missing in the string table", s)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+// Package sourcemap maps the addresses of a program to the source lines
+// that generated them, for profilers and coverage reports.
+//
+// A source map is written as text with one range of words per line: the
+// hexadecimal address, the number of words, "data" if the words are not
+// instructions, and the position in the source, like "001a 2 lib/print.dasm:14"
+// or "0040 8 data lib/print.dasm:30". Empty lines and lines starting with ';'
+// or '#' are ignored.
+package sourcemap
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Line is a range of words generated by a source line.
+type Line struct {
+	Addr uint16
+	Size int
+	File string
+	Line int
+	Data bool // the words are data rather than instructions
+}
+
+// Map is a list of lines sorted by address.
+type Map []Line
+
+func (m Map) Len() int           { return len(m) }
+func (m Map) Less(i, j int) bool { return m[i].Addr < m[j].Addr }
+func (m Map) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+
+// Lookup returns the line that generated the word at addr.
+func (m Map) Lookup(addr uint16) (Line, bool) {
+	i := sort.Search(len(m), func(i int) bool { return m[i].Addr > addr })
+	if i > 0 && int(addr) < int(m[i-1].Addr)+m[i-1].Size {
+		return m[i-1], true
+	}
+	return Line{}, false
+}
+
+// Files returns the names of the source files, sorted.
+func (m Map) Files() []string {
+	seen := make(map[string]bool)
+	files := make([]string, 0)
+	for _, l := range m {
+		if !seen[l.File] {
+			seen[l.File] = true
+			files = append(files, l.File)
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+// Write writes the map in the text format.
+func (m Map) Write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, l := range m {
+		data := ""
+		if l.Data {
+			data = "data "
+		}
+		fmt.Fprintf(bw, "%04x %d %s%s:%d\n", l.Addr, l.Size, data, l.File, l.Line)
+	}
+	return bw.Flush()
+}
+
+// WriteFile writes the map into the named file.
+func (m Map) WriteFile(filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err = m.Write(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Read reads a map in the text format and sorts it by address.
+func Read(r io.Reader) (Map, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	m := make(Map, 0)
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == ';' || line[0] == '#' {
+			continue
+		}
+		l, ok := parseLine(line)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("sourcemap: line %d: expected address, size and file:line", n+1))
+		}
+		m = append(m, l)
+	}
+	sort.Stable(m)
+	return m, nil
+}
+
+func parseLine(line string) (l Line, ok bool) {
+	fields := strings.SplitN(line, " ", 3)
+	if len(fields) != 3 {
+		return l, false
+	}
+	if strings.HasPrefix(fields[2], "data ") {
+		l.Data = true
+		fields[2] = fields[2][len("data "):]
+	}
+	colon := strings.LastIndex(fields[2], ":")
+	if colon < 0 {
+		return l, false
+	}
+	addr, err1 := strconv.ParseUint(fields[0], 16, 16)
+	size, err2 := strconv.Atoi(fields[1])
+	n, err3 := strconv.Atoi(fields[2][colon+1:])
+	if err1 != nil || err2 != nil || err3 != nil || size < 0 {
+		return l, false
+	}
+	return Line{uint16(addr), size, fields[2][:colon], n, l.Data}, true
+}
+
+// ReadFile reads the map from the named file.
+func ReadFile(filename string) (Map, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return Read(file)
+}
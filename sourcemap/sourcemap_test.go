@@ -0,0 +1,59 @@
+package sourcemap
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testMap = Map{
+	{0x0000, 2, "main.dasm", 1, false},
+	{0x0002, 3, "lib/print file.dasm", 14, false},
+	{0x0010, 1, "main.dasm", 7, true},
+}
+
+func TestReadWrite(t *testing.T) {
+	var buf bytes.Buffer
+	if err := testMap.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	exp := "0000 2 main.dasm:1\n0002 3 lib/print file.dasm:14\n0010 1 data main.dasm:7\n"
+	if buf.String() != exp {
+		t.Errorf("expected %q, got %q", exp, buf.String())
+	}
+	m, err := Read(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m, testMap) {
+		t.Errorf("expected %v, got %v", testMap, m)
+	}
+
+	if _, err := Read(strings.NewReader("# map\n0000 2 main.dasm\n")); err == nil ||
+		err.Error() != "sourcemap: line 2: expected address, size and file:line" {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	for _, c := range []struct {
+		addr uint16
+		line int
+		ok   bool
+	}{
+		{0x0000, 1, true},
+		{0x0004, 14, true},
+		{0x0005, 0, false},
+		{0x0010, 7, true},
+		{0x0011, 0, false},
+	} {
+		l, ok := testMap.Lookup(c.addr)
+		if ok != c.ok || l.Line != c.line {
+			t.Errorf("%04x: expected line %d, %v, got %d, %v", c.addr, c.line, c.ok, l.Line, ok)
+		}
+	}
+	if files := testMap.Files(); !reflect.DeepEqual(files, []string{"lib/print file.dasm", "main.dasm"}) {
+		t.Errorf("unexpected files %v", files)
+	}
+}
@@ -0,0 +1,154 @@
+// Package symbols reads and writes symbol maps, which name the addresses
+// of a program for debuggers, disassemblers and profilers.
+//
+// The text format lists one symbol per line as a hexadecimal address and
+// a name, like "001a loop". Empty lines and lines starting with ';' or '#'
+// are ignored. The JSON format is an array of objects, which also contain
+// the kind of a label, its size and where it is defined in the source
+// where known:
+//
+//	[{"name": "loop", "address": 26, "kind": "code", "size": 4, "file": "main.dasm", "line": 12}]
+package symbols
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Kinds of symbols.
+const (
+	Code = "code"
+	Data = "data"
+)
+
+// Symbol names an address.
+type Symbol struct {
+	Name string `json:"name"`
+	Addr uint16 `json:"address"`
+	Kind string `json:"kind,omitempty"` // Code, Data or empty if unknown
+	Size int    `json:"size,omitempty"` // number of words, or 0 if unknown
+	File string `json:"file,omitempty"` // source file of the definition, if known
+	Line int    `json:"line,omitempty"` // line of the definition, or 0 if unknown
+}
+
+// Map is a list of symbols sorted by address.
+type Map []Symbol
+
+func (m Map) Len() int { return len(m) }
+func (m Map) Less(i, j int) bool {
+	return m[i].Addr < m[j].Addr || m[i].Addr == m[j].Addr && m[i].Name < m[j].Name
+}
+func (m Map) Swap(i, j int) { m[i], m[j] = m[j], m[i] }
+
+// Lookup returns the first symbol at addr.
+func (m Map) Lookup(addr uint16) (sym Symbol, ok bool) {
+	i := sort.Search(len(m), func(i int) bool { return m[i].Addr >= addr })
+	if i < len(m) && m[i].Addr == addr {
+		return m[i], true
+	}
+	return Symbol{}, false
+}
+
+// Find returns the symbol an address belongs to, which is the closest
+// symbol at or below addr, and the offset of addr from it.
+func (m Map) Find(addr uint16) (sym Symbol, offset int, ok bool) {
+	i := sort.Search(len(m), func(i int) bool { return m[i].Addr > addr })
+	if i == 0 {
+		return Symbol{}, 0, false
+	}
+	// prefer the first of several symbols at the same address
+	for i > 1 && m[i-2].Addr == m[i-1].Addr {
+		i--
+	}
+	sym = m[i-1]
+	return sym, int(addr - sym.Addr), true
+}
+
+// Name returns addr as "symbol" or "symbol+offset", or an empty
+// string if no symbol lies at or below addr.
+func (m Map) Name(addr uint16) string {
+	sym, offset, ok := m.Find(addr)
+	switch {
+	case !ok:
+		return ""
+	case offset == 0:
+		return sym.Name
+	}
+	return fmt.Sprintf("%s+%d", sym.Name, offset)
+}
+
+// WriteText writes the map in the text format.
+func (m Map) WriteText(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, sym := range m {
+		fmt.Fprintf(bw, "%04x %s\n", sym.Addr, sym.Name)
+	}
+	return bw.Flush()
+}
+
+// WriteJSON writes the map in the JSON format.
+func (m Map) WriteJSON(w io.Writer) error {
+	if m == nil {
+		m = Map{}
+	}
+	data, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// Read reads a map in either format and sorts it by address.
+func Read(r io.Reader) (Map, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var m Map
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &m); err != nil {
+			return nil, errors.New("symbols: " + err.Error())
+		}
+	} else if m, err = readText(data); err != nil {
+		return nil, err
+	}
+	sort.Stable(m)
+	return m, nil
+}
+
+func readText(data []byte) (Map, error) {
+	m := make(Map, 0)
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == ';' || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		addr, err := strconv.ParseUint(strings.TrimPrefix(fields[0], "0x"), 16, 16)
+		if err != nil || len(fields) != 2 {
+			return nil, errors.New(fmt.Sprintf("symbols: line %d: expected address and name", n+1))
+		}
+		m = append(m, Symbol{Name: fields[1], Addr: uint16(addr)})
+	}
+	return m, nil
+}
+
+// ReadFile reads the map from the named file.
+func ReadFile(filename string) (Map, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return Read(file)
+}
@@ -0,0 +1,69 @@
+package symbols
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testMap = Map{
+	{"start", 0x0000, Code, 4, "main.dasm", 3},
+	{"loop", 0x0004, Code, 3, "main.dasm", 7},
+	{"table", 0x0010, Data, 8, "", 0},
+}
+
+func TestReadWrite(t *testing.T) {
+	var buf bytes.Buffer
+	if err := testMap.WriteJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	m, err := Read(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m, testMap) {
+		t.Errorf("expected %v, got %v", testMap, m)
+	}
+
+	buf.Reset()
+	if err := testMap.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if exp := "0000 start\n0004 loop\n0010 table\n"; buf.String() != exp {
+		t.Errorf("expected %q, got %q", exp, buf.String())
+	}
+	m, err = Read(strings.NewReader("; comment\n0x0010 table\n\n0004 loop\n0000 start\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, sym := range m {
+		if sym.Name != testMap[i].Name || sym.Addr != testMap[i].Addr {
+			t.Errorf("expected %v, got %v", testMap[i], sym)
+		}
+	}
+
+	if _, err := Read(strings.NewReader("0000 start\nloop\n")); err == nil ||
+		err.Error() != "symbols: line 2: expected address and name" {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestName(t *testing.T) {
+	for _, c := range []struct {
+		addr uint16
+		name string
+	}{
+		{0x0000, "start"},
+		{0x0003, "start+3"},
+		{0x0004, "loop"},
+		{0x0012, "table+2"},
+	} {
+		if name := testMap.Name(c.addr); name != c.name {
+			t.Errorf("%04x: expected %s, got %s", c.addr, c.name, name)
+		}
+	}
+	if name := (Map{{Name: "data", Addr: 0x10, Kind: Data}}).Name(0x0f); name != "" {
+		t.Errorf("expected no name below the first symbol, got %s", name)
+	}
+}
@@ -0,0 +1,70 @@
+package trace
+
+import (
+	"github.com/xconstruct/dcpu16/emulator"
+	"io"
+	"reflect"
+)
+
+// Divergence describes the first step in which two traces differ.
+type Divergence struct {
+	Step    int                    // number of the step, counted from 0
+	Context []*emulator.TraceStep // the equal steps before it, oldest first
+	A, B    *emulator.TraceStep   // the steps of both traces, nil if a trace ended
+	What    string                 // "PC", "registers", "memory writes" or "length"
+}
+
+// Diff reads two traces until their steps differ in the address, the
+// changed registers or the written words, or until one of them ends before
+// the other. It returns the first difference with up to context steps
+// before it, or nil if the traces are equal. The number of compared
+// steps is returned in either case. A negative context is taken as 0.
+func Diff(a, b *Reader, context int) (d *Divergence, steps int, err error) {
+	if context < 0 {
+		context = 0
+	}
+	prev := make([]*emulator.TraceStep, 0, context)
+	for n := 0; ; n++ {
+		sa, err := a.Next()
+		if err != nil && err != io.EOF {
+			return nil, n, err
+		}
+		sb, err := b.Next()
+		if err != nil && err != io.EOF {
+			return nil, n, err
+		}
+		if sa == nil && sb == nil {
+			return nil, n, nil
+		}
+
+		what := ""
+		switch {
+		case sa == nil || sb == nil:
+			what = "length"
+		case sa.PC != sb.PC:
+			what = "PC"
+		case !equalRegs(sa.Regs, sb.Regs):
+			what = "registers"
+		case !equalWrites(sa.Writes, sb.Writes):
+			what = "memory writes"
+		}
+		if what != "" {
+			return &Divergence{n, prev, sa, sb, what}, n, nil
+		}
+
+		if context > 0 {
+			if len(prev) == context {
+				prev = append(prev[:0], prev[1:]...)
+			}
+			prev = append(prev, sa)
+		}
+	}
+}
+
+func equalRegs(a, b []emulator.RegChange) bool {
+	return len(a) == len(b) && (len(a) == 0 || reflect.DeepEqual(a, b))
+}
+
+func equalWrites(a, b []emulator.MemWrite) bool {
+	return len(a) == len(b) && (len(a) == 0 || reflect.DeepEqual(a, b))
+}
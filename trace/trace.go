@@ -0,0 +1,282 @@
+// Package trace records the instructions executed by a DCPU, so that runs
+// of different programs or emulators can be compared.
+//
+// A trace lists each executed instruction with its address, its words, the
+// registers it changed and the words it wrote to the RAM. PC is listed as
+// a changed register after jumps and skipped instructions only.
+//
+// The text format has one line per instruction, with the address and the
+// words, the disassembled instruction and the changes, separated by "|":
+//
+//	0000 7c01 0030 | SET A, 0x0030 | A=0030
+//	0002 7de1 1000 0020 | SET [0x1000], 0x0020 | [1000]=0020
+//	0008 7dc1 001a | SET PC, 0x001a | PC=001a
+//
+// The binary format consists of big-endian values:
+//
+//	magic     "DCPT"
+//	version   uint16
+//	steps     for each: uint16 address, then uint8 counts of words,
+//	          registers and writes, the words, uint8 register and
+//	          uint16 value for each register, and uint16 address and
+//	          uint16 value for each write
+package trace
+
+import (
+	"github.com/xconstruct/dcpu16/disassembler"
+	"github.com/xconstruct/dcpu16/emulator"
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	magic   = "DCPT"
+	version = 1
+)
+
+// Format is the encoding of a trace.
+type Format int
+
+const (
+	Text Format = iota
+	Binary
+)
+
+// ParseFormat returns the format named "text" or "binary".
+func ParseFormat(name string) (Format, error) {
+	switch name {
+	case "text":
+		return Text, nil
+	case "binary":
+		return Binary, nil
+	}
+	return Text, errors.New(fmt.Sprintf("trace: unknown format %q", name))
+}
+
+// RegisterNames are the names of the registers in the numbering
+// of emulator.RegChange.
+var RegisterNames = append(append([]string{}, disassembler.Registers...), "SP", "O", "PC")
+
+// Register returns the number of the named register, or -1.
+func Register(name string) int {
+	for n, r := range RegisterNames {
+		if r == name {
+			return n
+		}
+	}
+	return -1
+}
+
+// Writer writes a trace of the instructions passed to Trace. It is an
+// emulator.Tracer. The first error is kept and returned by Flush.
+type Writer struct {
+	w      *bufio.Writer
+	format Format
+	err    error
+}
+
+// NewWriter returns a Writer that writes a trace in the format to w.
+func NewWriter(w io.Writer, format Format) *Writer {
+	tw := &Writer{w: bufio.NewWriter(w), format: format}
+	if format == Binary {
+		tw.w.WriteString(magic)
+		tw.put(uint16(version))
+	}
+	return tw
+}
+
+func (w *Writer) put(v interface{}) {
+	if w.err == nil {
+		w.err = binary.Write(w.w, binary.BigEndian, v)
+	}
+}
+
+// Trace writes a step.
+func (w *Writer) Trace(s *emulator.TraceStep) {
+	if w.err != nil {
+		return
+	}
+	if w.format == Binary {
+		w.put(s.PC)
+		w.put([]uint8{uint8(len(s.Words)), uint8(len(s.Regs)), uint8(len(s.Writes))})
+		w.put(s.Words)
+		for _, r := range s.Regs {
+			w.put(uint8(r.Reg))
+			w.put(r.Value)
+		}
+		for _, m := range s.Writes {
+			w.put(m.Addr)
+			w.put(m.Value)
+		}
+		return
+	}
+	_, w.err = fmt.Fprintln(w.w, FormatStep(s))
+}
+
+// Flush writes any buffered data and returns the first error.
+func (w *Writer) Flush() error {
+	if w.err != nil {
+		return w.err
+	}
+	return w.w.Flush()
+}
+
+// FormatStep returns a step as a line of the text format.
+func FormatStep(s *emulator.TraceStep) string {
+	words := fmt.Sprintf("%04x", s.PC)
+	for _, v := range s.Words {
+		words += fmt.Sprintf(" %04x", v)
+	}
+	instr, _ := disassembler.InstructionString(s.Words)
+	return fmt.Sprintf("%s | %s | %s", words, instr, FormatChanges(s))
+}
+
+// FormatChanges returns the changed registers and written words of a step
+// as in the text format.
+func FormatChanges(s *emulator.TraceStep) string {
+	changes := make([]string, 0, len(s.Regs)+len(s.Writes))
+	for _, r := range s.Regs {
+		changes = append(changes, fmt.Sprintf("%s=%04x", RegisterNames[r.Reg], r.Value))
+	}
+	for _, m := range s.Writes {
+		changes = append(changes, fmt.Sprintf("[%04x]=%04x", m.Addr, m.Value))
+	}
+	return strings.Join(changes, " ")
+}
+
+// Reader reads the steps of a trace in either format.
+type Reader struct {
+	r      *bufio.Reader
+	format Format
+	line   int
+}
+
+// NewReader returns a Reader for the trace in r, whose format is detected.
+func NewReader(r io.Reader) (*Reader, error) {
+	tr := &Reader{r: bufio.NewReader(r), format: Text}
+	head, err := tr.r.Peek(len(magic))
+	if err == nil && string(head) == magic {
+		tr.format = Binary
+		tr.r.Discard(len(magic))
+		var v uint16
+		if err := binary.Read(tr.r, binary.BigEndian, &v); err != nil {
+			return nil, errors.New("trace: truncated trace")
+		}
+		if v != version {
+			return nil, errors.New(fmt.Sprintf("trace: unsupported version %d", v))
+		}
+	}
+	return tr, nil
+}
+
+// Next returns the next step, or io.EOF at the end of the trace.
+func (r *Reader) Next() (*emulator.TraceStep, error) {
+	if r.format == Binary {
+		return r.nextBinary()
+	}
+	for {
+		line, err := r.r.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return nil, io.EOF
+		} else if err != nil && err != io.EOF {
+			return nil, err
+		}
+		r.line++
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		s, err := parseStep(line)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("trace: line %d: %s", r.line, err))
+		}
+		return s, nil
+	}
+}
+
+func (r *Reader) nextBinary() (*emulator.TraceStep, error) {
+	s := &emulator.TraceStep{}
+	if err := binary.Read(r.r, binary.BigEndian, &s.PC); err == io.EOF {
+		return nil, io.EOF
+	} else if err != nil {
+		return nil, errors.New("trace: truncated trace")
+	}
+	var counts [3]uint8
+	err := binary.Read(r.r, binary.BigEndian, &counts)
+	s.Words = make([]uint16, counts[0])
+	if err == nil {
+		err = binary.Read(r.r, binary.BigEndian, s.Words)
+	}
+	for i := 0; i < int(counts[1]) && err == nil; i++ {
+		var reg struct {
+			Reg   uint8
+			Value uint16
+		}
+		err = binary.Read(r.r, binary.BigEndian, &reg)
+		if int(reg.Reg) >= len(RegisterNames) {
+			return nil, errors.New(fmt.Sprintf("trace: invalid register %d", reg.Reg))
+		}
+		s.Regs = append(s.Regs, emulator.RegChange{Reg: int(reg.Reg), Value: reg.Value})
+	}
+	for i := 0; i < int(counts[2]) && err == nil; i++ {
+		var m emulator.MemWrite
+		err = binary.Read(r.r, binary.BigEndian, &m)
+		s.Writes = append(s.Writes, m)
+	}
+	if err != nil {
+		return nil, errors.New("trace: truncated trace")
+	}
+	return s, nil
+}
+
+// parseStep parses a line of the text format.
+func parseStep(line string) (*emulator.TraceStep, error) {
+	parts := strings.Split(line, "|")
+	if len(parts) != 3 {
+		return nil, errors.New("expected address and words, instruction and changes")
+	}
+	s := &emulator.TraceStep{}
+	if len(strings.Fields(parts[0])) < 2 {
+		return nil, errors.New("expected address and words")
+	}
+	for i, field := range strings.Fields(parts[0]) {
+		v, err := strconv.ParseUint(field, 16, 16)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid word %q", field))
+		}
+		if i == 0 {
+			s.PC = uint16(v)
+		} else {
+			s.Words = append(s.Words, uint16(v))
+		}
+	}
+	for _, field := range strings.Fields(parts[2]) {
+		i := strings.Index(field, "=")
+		if i < 0 {
+			return nil, errors.New(fmt.Sprintf("invalid change %q", field))
+		}
+		v, err := strconv.ParseUint(field[i+1:], 16, 16)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid change %q", field))
+		}
+		name := field[:i]
+		if strings.HasPrefix(name, "[") && strings.HasSuffix(name, "]") {
+			addr, err := strconv.ParseUint(name[1:len(name)-1], 16, 16)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("invalid change %q", field))
+			}
+			s.Writes = append(s.Writes, emulator.MemWrite{Addr: uint16(addr), Value: uint16(v)})
+			continue
+		}
+		reg := Register(name)
+		if reg < 0 {
+			return nil, errors.New(fmt.Sprintf("invalid change %q", field))
+		}
+		s.Regs = append(s.Regs, emulator.RegChange{Reg: reg, Value: uint16(v)})
+	}
+	return s, nil
+}
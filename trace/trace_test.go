@@ -0,0 +1,126 @@
+package trace
+
+import (
+	"github.com/xconstruct/dcpu16/emulator"
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var steps = []*emulator.TraceStep{
+	{PC: 0x0000, Words: []uint16{0x7c01, 0x0030}, Regs: []emulator.RegChange{{Reg: 0, Value: 0x0030}}},
+	{PC: 0x0002, Words: []uint16{0x7de1, 0x1000, 0x0020}, Writes: []emulator.MemWrite{{Addr: 0x1000, Value: 0x0020}}},
+	{PC: 0x0005, Words: []uint16{0x7c10, 0x0018}, Regs: []emulator.RegChange{
+		{Reg: emulator.RegSP, Value: 0xffff}, {Reg: emulator.RegPC, Value: 0x0018},
+	}, Writes: []emulator.MemWrite{{Addr: 0xffff, Value: 0x0007}}},
+}
+
+func readAll(t *testing.T, r io.Reader) []*emulator.TraceStep {
+	tr, err := NewReader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]*emulator.TraceStep, 0)
+	for {
+		s, err := tr.Next()
+		if err == io.EOF {
+			return got
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, s)
+	}
+}
+
+func TestReadWrite(t *testing.T) {
+	for _, f := range []Format{Text, Binary} {
+		var buf bytes.Buffer
+		w := NewWriter(&buf, f)
+		for _, s := range steps {
+			w.Trace(s)
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if f == Text {
+			exp := `0000 7c01 0030 | SET A, 0x0030 | A=0030
+0002 7de1 1000 0020 | SET [0x1000], 0x0020 | [1000]=0020
+0005 7c10 0018 | JSR 0x0018 | SP=ffff PC=0018 [ffff]=0007
+`
+			if buf.String() != exp {
+				t.Errorf("expected\n%s\ngot\n%s", exp, buf.String())
+			}
+		}
+		if got := readAll(t, &buf); !reflect.DeepEqual(got, steps) {
+			t.Errorf("format %d: expected %v, got %v", f, steps, got)
+		}
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	for _, c := range []struct {
+		src, err string
+	}{
+		{"0000 7c01 0030 | SET A, 0x30\n", "trace: line 1: expected address and words, instruction and changes"},
+		{"\n0000 | SET A, 0x30 | A=0030\n", "trace: line 2: expected address and words"},
+		{"0000 7c01 | SET A, 0x30 | Q=0030\n", `trace: line 1: invalid change "Q=0030"`},
+		{"DCPT\x00\x01\x00\x00\x01", "trace: truncated trace"},
+	} {
+		r, err := NewReader(strings.NewReader(c.src))
+		if err == nil {
+			_, err = r.Next()
+		}
+		if err == nil || err.Error() != c.err {
+			t.Errorf("%q: expected error %q, got %v", c.src, c.err, err)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	write := func(steps []*emulator.TraceStep) *Reader {
+		var buf bytes.Buffer
+		w := NewWriter(&buf, Binary)
+		for _, s := range steps {
+			w.Trace(s)
+		}
+		w.Flush()
+		r, err := NewReader(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	d, n, err := Diff(write(steps), write(steps), 2)
+	if d != nil || n != 3 || err != nil {
+		t.Errorf("expected equal traces of 3 steps, got %v, %d, %v", d, n, err)
+	}
+
+	changed := append([]*emulator.TraceStep{}, steps...)
+	last := *steps[2]
+	last.Writes = []emulator.MemWrite{{Addr: 0xffff, Value: 0x0008}}
+	changed[2] = &last
+	d, n, err = Diff(write(steps), write(changed), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := &Divergence{2, steps[1:2], steps[2], &last, "memory writes"}
+	if !reflect.DeepEqual(d, exp) {
+		t.Errorf("expected %+v, got %+v", exp, d)
+	}
+
+	d, n, err = Diff(write(steps), write(steps[:1]), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d == nil || d.Step != 1 || d.What != "length" || d.B != nil || len(d.Context) != 1 {
+		t.Errorf("expected the second trace to end at step 1, got %+v", d)
+	}
+
+	d, n, err = Diff(write(steps), write(changed), -1)
+	if err != nil || d == nil || d.Step != 2 || len(d.Context) != 0 {
+		t.Errorf("expected a difference at step 2 without context, got %+v, %v", d, err)
+	}
+}
@@ -0,0 +1,193 @@
+package words
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Chars selects the character column of a dump.
+type Chars int
+
+const (
+	NoChars     Chars = iota
+	ASCIIChars        // the low byte of each word, as the screen shows it
+	PackedChars       // two characters per word, high byte first
+)
+
+// ParseChars returns the character column with the given name,
+// which is one of "none", "ascii" and "packed".
+func ParseChars(name string) (Chars, error) {
+	switch name {
+	case "none":
+		return NoChars, nil
+	case "ascii":
+		return ASCIIChars, nil
+	case "packed":
+		return PackedChars, nil
+	}
+	return NoChars, errors.New(fmt.Sprintf("words: unknown character column %q", name))
+}
+
+// DumpOptions selects what a dump shows.
+type DumpOptions struct {
+	Start  int   // address of the first word
+	Length int   // number of words, or 0 for all words up to the end
+	Width  int   // words per line, or 0 for 8
+	Chars  Chars // character column
+	All    bool  // show repeated lines instead of collapsing them into "*"
+}
+
+// lines returns the range of words to dump and the width of a line.
+func (o DumpOptions) lines(n int) (start, end, width int) {
+	start, end, width = o.Start, n, o.Width
+	if o.Length > 0 && start+o.Length < end {
+		end = start + o.Length
+	}
+	if start > end {
+		start = end
+	}
+	if width <= 0 {
+		width = 8
+	}
+	return
+}
+
+// Dump writes the words of src in lines of their address, the words and the
+// character column. A run of lines that repeat the line before them is
+// collapsed into a single "*", except for the last line of the dump.
+func Dump(w io.Writer, src []uint16, opts DumpOptions) error {
+	bw := bufio.NewWriter(w)
+	start, end, width := opts.lines(len(src))
+	collapsed := false
+	for addr := start; addr < end; addr += width {
+		n := width
+		if addr+n > end {
+			n = end - addr
+		}
+		line := src[addr : addr+n]
+		prev := addr - width
+		last := addr+n >= end
+		if !opts.All && !last && prev >= start && equal(line, src[prev:prev+n]) {
+			if !collapsed {
+				fmt.Fprintln(bw, "*")
+				collapsed = true
+			}
+			continue
+		}
+		collapsed = false
+		fmt.Fprintf(bw, "0x%04x:   ", addr)
+		for _, v := range line {
+			fmt.Fprintf(bw, " 0x%04x", v)
+		}
+		writeChars(bw, line, (width-n)*7, opts.Chars)
+		fmt.Fprintln(bw)
+	}
+	return bw.Flush()
+}
+
+// DumpDiff writes the lines in which the words of a and b differ, first as
+// in a, prefixed by "-", then as in b, prefixed by "+". The differing words
+// are enclosed in brackets, and words beyond the end of one of the images
+// are left blank. Runs of equal lines are collapsed into a single "*".
+func DumpDiff(w io.Writer, a, b []uint16, opts DumpOptions) error {
+	bw := bufio.NewWriter(w)
+	n := len(a)
+	if len(b) > n {
+		n = len(b)
+	}
+	start, end, width := opts.lines(n)
+	skipped := false
+	for addr := start; addr < end; addr += width {
+		lineEnd := addr + width
+		if lineEnd > end {
+			lineEnd = end
+		}
+		changed := make([]bool, lineEnd-addr)
+		differs := false
+		for i := range changed {
+			va, oka := word(a, addr+i)
+			vb, okb := word(b, addr+i)
+			changed[i] = va != vb || oka != okb
+			differs = differs || changed[i]
+		}
+		if !differs {
+			if !skipped && addr > start {
+				fmt.Fprintln(bw, "*")
+			}
+			skipped = true
+			continue
+		}
+		skipped = false
+		for _, side := range []struct {
+			prefix string
+			mem    []uint16
+		}{{"-", a}, {"+", b}} {
+			fmt.Fprintf(bw, "%s0x%04x:  ", side.prefix, addr)
+			for i := range changed {
+				v, ok := word(side.mem, addr+i)
+				switch {
+				case !ok && changed[i]:
+					fmt.Fprint(bw, " [      ]")
+				case changed[i]:
+					fmt.Fprintf(bw, " [0x%04x]", v)
+				default:
+					fmt.Fprintf(bw, "  0x%04x ", v)
+				}
+			}
+			line := side.mem[clamp(addr, len(side.mem)):clamp(lineEnd, len(side.mem))]
+			writeChars(bw, line, (width-len(changed))*9, opts.Chars)
+			fmt.Fprintln(bw)
+		}
+	}
+	return bw.Flush()
+}
+
+func word(mem []uint16, addr int) (uint16, bool) {
+	if addr < len(mem) {
+		return mem[addr], true
+	}
+	return 0, false
+}
+
+func clamp(i, n int) int {
+	if i > n {
+		return n
+	}
+	return i
+}
+
+func equal(a, b []uint16) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// writeChars writes the character column of a line after pad spaces,
+// which line up the columns of short lines with full ones.
+func writeChars(w io.Writer, line []uint16, pad int, chars Chars) {
+	if chars == NoChars {
+		return
+	}
+	buf := make([]byte, 0, 2*len(line))
+	for _, v := range line {
+		if chars == PackedChars {
+			buf = append(buf, printable(byte(v>>8)))
+		}
+		buf = append(buf, printable(byte(v)))
+	}
+	fmt.Fprintf(w, "%s  |%s|", strings.Repeat(" ", pad), buf)
+}
+
+// printable returns c if it is a printable ASCII character, and '.' otherwise.
+func printable(c byte) byte {
+	if c < 0x20 || c > 0x7e {
+		return '.'
+	}
+	return c
+}
@@ -0,0 +1,259 @@
+package words
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Format is an encoding of a memory image in a file.
+type Format int
+
+// Formats of memory images.
+//
+// BigEndian and LittleEndian store each word as two bytes. Hex is text with
+// four hexadecimal digits per word, separated by white space. IntelHex
+// consists of Intel HEX records of the big-endian bytes, addressed in bytes,
+// which start with ':'.
+const (
+	BigEndian Format = iota
+	LittleEndian
+	Hex
+	IntelHex
+)
+
+var formatNames = []string{"big", "little", "hex", "ihex"}
+
+// String returns the name of the format, which ParseFormat accepts.
+func (f Format) String() string {
+	if f < 0 || int(f) >= len(formatNames) {
+		return fmt.Sprintf("Format(%d)", int(f))
+	}
+	return formatNames[f]
+}
+
+// ParseFormat returns the format with the given name.
+func ParseFormat(name string) (Format, error) {
+	for i, n := range formatNames {
+		if n == name {
+			return Format(i), nil
+		}
+	}
+	return 0, errors.New(fmt.Sprintf("words: unknown format %q, expected one of %s", name, strings.Join(formatNames, ", ")))
+}
+
+// hexRecordSize is the number of data bytes in each written Intel HEX record.
+const hexRecordSize = 16
+
+// Encode writes the words of src to w in the format.
+func Encode(w io.Writer, src []uint16, f Format) error {
+	bw := bufio.NewWriter(w)
+	switch f {
+	case BigEndian:
+		for _, v := range src {
+			a, b := WordToBytes(v)
+			bw.Write([]byte{a, b})
+		}
+	case LittleEndian:
+		for _, v := range src {
+			a, b := WordToBytes(v)
+			bw.Write([]byte{b, a})
+		}
+	case Hex:
+		for i, v := range src {
+			sep := " "
+			if i%8 == 7 || i == len(src)-1 {
+				sep = "\n"
+			}
+			fmt.Fprintf(bw, "%04x%s", v, sep)
+		}
+	case IntelHex:
+		data := make([]byte, 2*len(src))
+		CopyToBytes(data, src)
+		for addr := 0; addr < len(data); addr += hexRecordSize {
+			if addr > 0 && addr&0xffff == 0 {
+				writeRecord(bw, 0, 0x04, []byte{byte(addr >> 24), byte(addr >> 16)})
+			}
+			end := addr + hexRecordSize
+			if end > len(data) {
+				end = len(data)
+			}
+			writeRecord(bw, uint16(addr), 0x00, data[addr:end])
+		}
+		writeRecord(bw, 0, 0x01, nil)
+	default:
+		return errors.New("words: cannot encode " + f.String())
+	}
+	return bw.Flush()
+}
+
+// writeRecord writes a single Intel HEX record.
+func writeRecord(w io.Writer, addr uint16, typ byte, data []byte) {
+	rec := append([]byte{byte(len(data)), byte(addr >> 8), byte(addr), typ}, data...)
+	sum := byte(0)
+	for _, b := range rec {
+		sum += b
+	}
+	fmt.Fprintf(w, ":%X%02X\n", rec, -sum)
+}
+
+// Decode reads the words of an image in the format. Images of an odd number
+// of bytes are padded with a zero byte.
+func Decode(data []byte, f Format) ([]uint16, error) {
+	switch f {
+	case BigEndian:
+		mem := make([]uint16, (len(data)+1)/2)
+		CopyFromBytes(mem, data)
+		return mem, nil
+	case LittleEndian:
+		mem := make([]uint16, (len(data)+1)/2)
+		for i := range mem {
+			mem[i] = uint16(data[2*i])
+			if 2*i+1 < len(data) {
+				mem[i] |= uint16(data[2*i+1]) << 8
+			}
+		}
+		return mem, nil
+	case Hex:
+		return decodeHex(data)
+	case IntelHex:
+		return decodeIntelHex(data)
+	}
+	return nil, errors.New("words: cannot decode " + f.String())
+}
+
+func decodeHex(data []byte) ([]uint16, error) {
+	fields := strings.Fields(string(data))
+	mem := make([]uint16, len(fields))
+	for i, field := range fields {
+		v, err := strconv.ParseUint(strings.TrimPrefix(field, "0x"), 16, 16)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("words: invalid hex word %q", field))
+		}
+		mem[i] = uint16(v)
+	}
+	return mem, nil
+}
+
+func decodeIntelHex(data []byte) ([]uint16, error) {
+	image := make([]byte, 0)
+	base := 0
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		fail := func(msg string) ([]uint16, error) {
+			return nil, errors.New(fmt.Sprintf("words: line %d: %s", n+1, msg))
+		}
+		if line[0] != ':' || len(line)%2 != 1 {
+			return fail("invalid Intel HEX record")
+		}
+		rec := make([]byte, len(line)/2)
+		for i := range rec {
+			v, err := strconv.ParseUint(line[1+2*i:3+2*i], 16, 8)
+			if err != nil {
+				return fail("invalid Intel HEX record")
+			}
+			rec[i] = byte(v)
+		}
+		if len(rec) < 5 || int(rec[0]) != len(rec)-5 {
+			return fail("length of record does not match its data")
+		}
+		sum := byte(0)
+		for _, b := range rec {
+			sum += b
+		}
+		if sum != 0 {
+			return fail("checksum mismatch")
+		}
+
+		addr, payload := int(rec[1])<<8|int(rec[2]), rec[4:len(rec)-1]
+		switch rec[3] {
+		case 0x00: // data
+			addr += base
+			if addr+len(payload) > 0x20000 {
+				return fail("data exceeds the address space")
+			}
+			for len(image) < addr+len(payload) {
+				image = append(image, 0)
+			}
+			copy(image[addr:], payload)
+		case 0x01: // end of file
+			return Decode(image, BigEndian)
+		case 0x02: // extended segment address
+			if len(payload) != 2 {
+				return fail("invalid extended address")
+			}
+			base = (int(payload[0])<<8 | int(payload[1])) << 4
+		case 0x04: // extended linear address
+			if len(payload) != 2 {
+				return fail("invalid extended address")
+			}
+			base = (int(payload[0])<<8 | int(payload[1])) << 16
+		case 0x03, 0x05: // start addresses are ignored
+		default:
+			return fail(fmt.Sprintf("unsupported record type %02x", rec[3]))
+		}
+	}
+	return nil, errors.New("words: missing Intel HEX end of file record")
+}
+
+// DetectFormat guesses the format of an image. Text is only recognized if
+// it cannot be mistaken for binary words: Intel HEX if all its lines are
+// records with valid checksums ending in an end of file record, and Hex if
+// it ends in a newline and all its fields are words of four hexadecimal
+// digits. Other images are BigEndian, as little-endian images cannot be
+// told apart reliably.
+func DetectFormat(data []byte) Format {
+	switch {
+	case isIntelHex(data):
+		return IntelHex
+	case isHexText(data):
+		return Hex
+	}
+	return BigEndian
+}
+
+func isIntelHex(data []byte) bool {
+	lines := strings.Split(strings.TrimRight(string(data), "\r\n"), "\n")
+	for i, line := range lines {
+		line = strings.TrimSuffix(line, "\r")
+		if len(line) < 11 || line[0] != ':' || len(line)%2 == 0 {
+			return false
+		}
+		rec, err := hex.DecodeString(line[1:])
+		if err != nil || len(rec) != 5+int(rec[0]) {
+			return false
+		}
+		sum := byte(0)
+		for _, b := range rec {
+			sum += b
+		}
+		if sum != 0 || (i == len(lines)-1) != (rec[3] == 0x01) {
+			return false
+		}
+	}
+	return true
+}
+
+func isHexText(data []byte) bool {
+	if len(data) == 0 || data[len(data)-1] != '\n' {
+		return false
+	}
+	for _, field := range strings.Fields(string(data)) {
+		if len(field) != 4 {
+			return false
+		}
+		for _, c := range field {
+			if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F') {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -4,7 +4,6 @@ package words
 import (
 	"errors"
 	"io"
-	"fmt"
 )
 
 // BytesToWord converts two bytes into a single word
@@ -111,24 +110,8 @@ func NewReadWriter(w []uint16) * ReadWriter {
 	return &ReadWriter{w, 0}
 }
 
-// Hexdump displays the word slice in a readable format.
+// Hexdump displays the word slice in a readable format, with 8 words
+// per line. Repeated lines are collapsed as by Dump.
 func Hexdump(src []uint16, dest io.Writer) {
-	for l := 0; l < (len(src) / 8); l++ {
-		lineNull := true
-		for c := 0; c < 8; c++ {
-			if src[l*8+c] != 0 {
-				lineNull = false
-				break
-			}
-		}
-		if lineNull {
-			continue
-		}
-
-		fmt.Fprintf(dest, "0x%04x:    ", l*8)
-		for c := 0; c < 8; c++ {
-			fmt.Fprintf(dest, "0x%04x ", src[l*8+c])
-		}
-		fmt.Fprintln(dest)
-	}
+	Dump(dest, src, DumpOptions{})
 }
@@ -1,8 +1,10 @@
 package words
 
 import (
+	"bytes"
 	"io"
 	"os"
+	"reflect"
 	"testing"
 )
 
@@ -40,3 +42,129 @@ func TestReadWriter(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestFormats(t *testing.T) {
+	for f := BigEndian; f <= IntelHex; f++ {
+		var buf bytes.Buffer
+		if err := Encode(&buf, notchMem, f); err != nil {
+			t.Fatal(err)
+		}
+		exp := f
+		if f == LittleEndian {
+			exp = BigEndian
+		}
+		if detected := DetectFormat(buf.Bytes()); detected != exp {
+			t.Errorf("%s: detected %s", f, detected)
+		}
+		mem, err := Decode(buf.Bytes(), f)
+		if err != nil {
+			t.Fatalf("%s: %s", f, err)
+		}
+		if !reflect.DeepEqual(mem, notchMem) {
+			t.Errorf("%s: expected %04x, got %04x", f, notchMem, mem)
+		}
+	}
+}
+
+func TestDetectFormat(t *testing.T) {
+	for _, mem := range [][]uint16{
+		{0x0012, 0x7803, 0x1000, 0x61c1}, // ADD A, B; SUB C, [0x1000]; SET PC, POP
+		{0x3031, 0x3233},
+		{0x3031, 0x3233, 0x340a},
+		{0x3a3a},
+		{},
+	} {
+		var buf bytes.Buffer
+		Encode(&buf, mem, BigEndian)
+		if f := DetectFormat(buf.Bytes()); f != BigEndian {
+			t.Errorf("%04x: detected %s", mem, f)
+		}
+	}
+	for text, exp := range map[string]Format{
+		":00000001FF\n":                      IntelHex,
+		":020000000102FB\r\n:00000001FF\r\n": IntelHex,
+		":020000000102FB\n":                  BigEndian, // no end of file record
+		"0001 0002\n":                        Hex,
+		"0x01 0002\n":                        BigEndian,
+		"0001 0002":                          BigEndian,
+	} {
+		if f := DetectFormat([]byte(text)); f != exp {
+			t.Errorf("%q: detected %s, expected %s", text, f, exp)
+		}
+	}
+}
+
+func TestIntelHex(t *testing.T) {
+	var buf bytes.Buffer
+	Encode(&buf, []uint16{0x7c01, 0x0030}, IntelHex)
+	if exp := ":040000007C0100304F\n:00000001FF\n"; buf.String() != exp {
+		t.Errorf("expected %q, got %q", exp, buf.String())
+	}
+
+	// large images need extended addresses
+	mem := make([]uint16, 0x9000)
+	mem[0x8fff] = 0x1234
+	buf.Reset()
+	Encode(&buf, mem, IntelHex)
+	got, err := Decode(buf.Bytes(), IntelHex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, mem) {
+		t.Errorf("extended addresses were not decoded")
+	}
+
+	for _, c := range []struct {
+		src, err string
+	}{
+		{":040000007C010030CE\n:00000001FF\n", "words: line 1: checksum mismatch"},
+		{":050000007C0100304F\n", "words: line 1: length of record does not match its data"},
+		{"7c01\n", "words: line 1: invalid Intel HEX record"},
+		{":040000007C0100304F\n", "words: missing Intel HEX end of file record"},
+	} {
+		if _, err := Decode([]byte(c.src), IntelHex); err == nil || err.Error() != c.err {
+			t.Errorf("%q: expected error %q, got %v", c.src, c.err, err)
+		}
+	}
+}
+
+func TestDump(t *testing.T) {
+	mem := make([]uint16, 40)
+	copy(mem, []uint16{0x7c01, 0x0030})
+	copy(mem[32:], []uint16{0x48, 0x4869, 0})
+	var buf bytes.Buffer
+	Dump(&buf, mem, DumpOptions{Chars: ASCIIChars})
+	exp := `0x0000:    0x7c01 0x0030 0x0000 0x0000 0x0000 0x0000 0x0000 0x0000  |.0......|
+0x0008:    0x0000 0x0000 0x0000 0x0000 0x0000 0x0000 0x0000 0x0000  |........|
+*
+0x0020:    0x0048 0x4869 0x0000 0x0000 0x0000 0x0000 0x0000 0x0000  |Hi......|
+`
+	if buf.String() != exp {
+		t.Errorf("expected\n%s\ngot\n%s", exp, buf.String())
+	}
+
+	buf.Reset()
+	Dump(&buf, mem, DumpOptions{Start: 32, Length: 3, Width: 2, Chars: PackedChars})
+	exp = `0x0020:    0x0048 0x4869  |.HHi|
+0x0022:    0x0000         |..|
+`
+	if buf.String() != exp {
+		t.Errorf("expected\n%s\ngot\n%s", exp, buf.String())
+	}
+}
+
+func TestDumpDiff(t *testing.T) {
+	a := []uint16{1, 2, 3, 4, 0, 0, 0, 0, 5}
+	b := []uint16{1, 2, 3, 6, 0, 0, 0, 0}
+	var buf bytes.Buffer
+	DumpDiff(&buf, a, b, DumpOptions{Width: 4})
+	exp := `-0x0000:    0x0001   0x0002   0x0003  [0x0004]
++0x0000:    0x0001   0x0002   0x0003  [0x0006]
+*
+-0x0008:   [0x0005]
++0x0008:   [      ]
+`
+	if buf.String() != exp {
+		t.Errorf("expected\n%s\ngot\n%s", exp, buf.String())
+	}
+}